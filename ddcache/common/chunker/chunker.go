@@ -0,0 +1,128 @@
+package chunker
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	DefaultMinSize = 256 * 1024
+	DefaultAvgSize = 1024 * 1024
+	DefaultMaxSize = 4 * 1024 * 1024
+)
+
+// Params configures chunk sizes. AvgSize must be a power of two.
+type Params struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// DefaultParams are the chunk sizes used for DerivedData archives. Changing
+// them changes every chunk boundary and so invalidates all stored chunks.
+var DefaultParams = Params{
+	MinSize: DefaultMinSize,
+	AvgSize: DefaultAvgSize,
+	MaxSize: DefaultMaxSize,
+}
+
+// Chunker splits a stream into content-defined chunks using a gear rolling
+// hash with normalized chunking (FastCDC), so that local edits to the input
+// only change the chunks around the edit.
+type Chunker struct {
+	r      io.Reader
+	params Params
+	maskS  uint64
+	maskL  uint64
+	buf    []byte
+	n      int
+	eof    bool
+}
+
+func New(r io.Reader, p Params) (*Chunker, error) {
+	if p.MinSize <= 0 || p.AvgSize <= p.MinSize || p.MaxSize <= p.AvgSize {
+		return nil, errors.New("chunk sizes must satisfy 0 < min < avg < max")
+	}
+	if p.AvgSize&(p.AvgSize-1) != 0 {
+		return nil, errors.New("average chunk size must be a power of two")
+	}
+	avgBits := bits.TrailingZeros(uint(p.AvgSize))
+
+	return &Chunker{
+		r:      r,
+		params: p,
+		maskS:  topBits(avgBits + 1),
+		maskL:  topBits(avgBits - 1),
+		buf:    make([]byte, p.MaxSize),
+	}, nil
+}
+
+// Next returns the next chunk, or io.EOF once the input is exhausted.
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		n, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += n
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			c.eof = true
+		case err != nil:
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cutpoint(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.n = copy(c.buf, c.buf[cut:c.n])
+
+	return chunk, nil
+}
+
+func (c *Chunker) cutpoint(data []byte) int {
+	n := len(data)
+	if n <= c.params.MinSize {
+		return n
+	}
+	normal := min(c.params.AvgSize, n)
+
+	var fp uint64
+	i := c.params.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// topBits returns a mask of the n most significant bits. The high bits of the
+// gear hash depend on the last 64 bytes, the low bits only on the last few.
+func topBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed: the table must never change, otherwise
+	// chunk boundaries (and so every stored chunk) would change with it.
+	seed := uint64(0x6464636163686521)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
@@ -0,0 +1,135 @@
+package chunker_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/chunker"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+)
+
+// testParams are small chunk sizes, which give many chunks of little data.
+var testParams = chunker.Params{MinSize: 2 * 1024, AvgSize: 8 * 1024, MaxSize: 32 * 1024}
+
+func split(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+
+	c, err := chunker.New(bytes.NewReader(data), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunkSizesWithinBounds(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		chunks int
+	}{
+		{"Random", kvtest.RandomData(4 * 1024 * 1024), 0},
+		// Without cut points every chunk is cut at the maximum size.
+		{"Zeros", make([]byte, 1024*1024+5), 33},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := split(t, tc.data)
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tc.data) {
+				t.Fatalf("chunks have %d bytes, want the %d input bytes", len(got), len(tc.data))
+			}
+			if tc.chunks != 0 && len(chunks) != tc.chunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), tc.chunks)
+			}
+			for i, chunk := range chunks {
+				last := i == len(chunks)-1
+				if len(chunk) > testParams.MaxSize || len(chunk) < testParams.MinSize && !last {
+					t.Errorf("chunk %d of %d has %d bytes", i, len(chunks), len(chunk))
+				}
+			}
+		})
+	}
+}
+
+func TestChunkingIsDeterministic(t *testing.T) {
+	data := kvtest.RandomData(1024 * 1024)
+
+	first, err := chunker.BuildManifest(bytes.NewReader(data), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := chunker.BuildManifest(bytes.NewReader(data), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Chunks) < 2 || len(first.Chunks) != len(second.Chunks) {
+		t.Fatalf("got %d and %d chunks", len(first.Chunks), len(second.Chunks))
+	}
+	for i := range first.Chunks {
+		if first.Chunks[i] != second.Chunks[i] {
+			t.Fatalf("chunk %d is %+v, then %+v", i, first.Chunks[i], second.Chunks[i])
+		}
+	}
+}
+
+func TestChunksResynchronizeAfterEdit(t *testing.T) {
+	data := kvtest.RandomData(4 * 1024 * 1024)
+	middle := len(data) / 2
+	for _, tc := range []struct {
+		name   string
+		edited []byte
+	}{
+		{"Insert", append(append(append([]byte{}, data[:middle]...), kvtest.RandomData(100)...), data[middle:]...)},
+		{"Delete", append(append([]byte{}, data[:middle]...), data[middle+100:]...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			original, err := chunker.BuildManifest(bytes.NewReader(data), testParams)
+			if err != nil {
+				t.Fatal(err)
+			}
+			edited, err := chunker.BuildManifest(bytes.NewReader(tc.edited), testParams)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			shared := map[string]bool{}
+			for _, chunk := range original.Chunks {
+				shared[chunk.Sha256] = true
+			}
+			var changed int
+			for _, chunk := range edited.Chunks {
+				if !shared[chunk.Sha256] {
+					changed++
+				}
+			}
+			// The chunk around the edit changes, and maybe the next one
+			// until the boundaries line up again.
+			if changed > 2 {
+				t.Errorf("%d of %d chunks changed, want at most 2", changed, len(edited.Chunks))
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidParams(t *testing.T) {
+	for _, p := range []chunker.Params{
+		{MinSize: 0, AvgSize: 8, MaxSize: 16},
+		{MinSize: 8, AvgSize: 8, MaxSize: 16},
+		{MinSize: 4, AvgSize: 8, MaxSize: 8},
+		{MinSize: 4, AvgSize: 10, MaxSize: 16},
+	} {
+		if _, err := chunker.New(bytes.NewReader(nil), p); err == nil {
+			t.Errorf("New() accepted %+v", p)
+		}
+	}
+}
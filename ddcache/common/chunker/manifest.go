@@ -0,0 +1,78 @@
+package chunker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Manifest lists the chunks an archive was split into, in order.
+type Manifest struct {
+	Size   int64   `json:"size"`
+	Sha256 string  `json:"sha256"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+type Chunk struct {
+	Sha256 string `json:"sha256"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// ChunkKey is the storage key of a chunk. Chunks are content addressed, so
+// they are shared between branches.
+func ChunkKey(sha256Sum string) string {
+	return fmt.Sprintf("chunk-%s", sha256Sum)
+}
+
+// ManifestKey is the storage key of a branch's chunk manifest.
+func ManifestKey(branch string) string {
+	return fmt.Sprintf("%s-manifest", branch)
+}
+
+// BuildManifest splits r into chunks and returns the resulting manifest.
+func BuildManifest(r io.Reader, p Params) (Manifest, error) {
+	c, err := New(r, p)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var m Manifest
+	total := sha256.New()
+	for {
+		data, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Manifest{}, fmt.Errorf("read chunk: %w", err)
+		}
+		_, _ = total.Write(data) // never fails
+
+		sum := sha256.Sum256(data)
+		m.Chunks = append(m.Chunks, Chunk{
+			Sha256: hex.EncodeToString(sum[:]),
+			Offset: m.Size,
+			Size:   int64(len(data)),
+		})
+		m.Size += int64(len(data))
+	}
+	m.Sha256 = hex.EncodeToString(total.Sum(nil))
+
+	return m, nil
+}
+
+func (m Manifest) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func UnmarshalManifest(data []byte) (Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, fmt.Errorf("unmarshal manifest: %w", err)
+	}
+	return m, nil
+}
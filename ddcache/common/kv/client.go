@@ -3,24 +3,32 @@ package kv
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/telemetry"
 	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/proto/kv_storage"
+	"github.com/klauspost/compress/zstd"
 	"google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 )
 
 type Client struct {
+	conn             *grpc.ClientConn
 	bytestreamClient bytestream.ByteStreamClient
 	bitriseKVClient  kv_storage.KVStorageClient
 	clientName       string
-	token            string
+	tokens           TokenSource
+	chunkSize        int
+	compression      zstd.EncoderLevel
+	// buffers holds chunkSize buffers for writer.ReadFrom.
+	buffers sync.Pool
 }
 
 type NewClientParams struct {
@@ -29,68 +37,299 @@ type NewClientParams struct {
 	DialTimeout time.Duration
 	ClientName  string
 	Token       string
+	// TokenSource provides the access token, overriding Token when set.
+	TokenSource TokenSource
+	// CACertPath is a PEM bundle of CAs to verify the service with instead
+	// of the system roots.
+	CACertPath string
+	// ClientCertPath and ClientKeyPath are a PEM certificate and key presented
+	// to services requiring mutual TLS. They must be set together.
+	ClientCertPath string
+	ClientKeyPath  string
+	// ServerName overrides the name used to verify the service certificate.
+	ServerName string
+	// DialOptions are appended to the options the connection is dialed with.
+	DialOptions []grpc.DialOption
+	// KeepaliveTime is the interval of keepalive pings while calls are in
+	// progress, DefaultKeepaliveTime if zero. Servers close connections
+	// pinged more often than their enforcement policy allows.
+	KeepaliveTime time.Duration
+	// ChunkSize is the most data sent in a single WriteRequest of a Put,
+	// DefaultChunkSize if zero.
+	ChunkSize int
+	// MaxMessageSize is the largest message sent to or accepted from the
+	// service, DefaultMaxMessageSize if zero. It has to fit ChunkSize and the
+	// other fields of a WriteRequest.
+	MaxMessageSize int
+	// CompressionLevel makes Put compress blobs with zstd at this level,
+	// unless they turn out to be incompressible, and store them under their
+	// name with CompressedSuffix. Zero disables compression. Compressed
+	// uploads are compressed into a temporary file first, and can't be
+	// resumed.
+	CompressionLevel zstd.EncoderLevel
 }
 
+// DefaultKeepaliveTime detects broken connections during long transfers. It
+// is the minimum gRPC servers accept by default, pinging more often gets the
+// connection closed with GOAWAY too_many_pings.
+const DefaultKeepaliveTime = 5 * time.Minute
+
+const (
+	// DefaultChunkSize keeps the number of messages of large uploads low,
+	// while staying well below DefaultMaxMessageSize.
+	DefaultChunkSize = 1024 * 1024
+	// DefaultMaxMessageSize is the limit gRPC servers apply to received
+	// messages unless configured otherwise.
+	DefaultMaxMessageSize = 4 * 1024 * 1024
+	// writeRequestOverhead is reserved in WriteRequests for the resource
+	// name, the offset and the protobuf framing.
+	writeRequestOverhead = 16 * 1024
+)
+
 func NewClient(ctx context.Context, p NewClientParams) (*Client, error) {
+	chunkSize := p.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if maxMessageSize := maxMessageSize(p); chunkSize > maxMessageSize-writeRequestOverhead {
+		return nil, fmt.Errorf("chunk size %d doesn't fit in messages of at most %d bytes", chunkSize, maxMessageSize)
+	}
+
+	conn, err := Dial(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := p.TokenSource
+	if tokens == nil {
+		tokens = StaticToken(p.Token)
+	}
+
+	client := &Client{
+		conn:             conn,
+		bytestreamClient: bytestream.NewByteStreamClient(conn),
+		bitriseKVClient:  kv_storage.NewKVStorageClient(conn),
+		clientName:       p.ClientName,
+		tokens:           tokens,
+		chunkSize:        chunkSize,
+		compression:      p.CompressionLevel,
+	}
+	client.buffers.New = func() any {
+		buf := make([]byte, chunkSize)
+		return &buf
+	}
+	return client, nil
+}
+
+func maxMessageSize(p NewClientParams) int {
+	if p.MaxMessageSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return p.MaxMessageSize
+}
+
+// Dial connects to p.Host with the transport security, keepalive and dial
+// options of p, tracing and measuring the calls with the telemetry package.
+// It is used by NewClient, and by other gRPC based backends.
+func Dial(ctx context.Context, p NewClientParams) (*grpc.ClientConn, error) {
 	ctx, cancel := context.WithTimeout(ctx, p.DialTimeout)
 	defer cancel()
-	creds := credentials.NewTLS(&tls.Config{})
+	var creds credentials.TransportCredentials
 	if p.UseInsecure {
+		if p.CACertPath != "" || p.ClientCertPath != "" || p.ClientKeyPath != "" || p.ServerName != "" {
+			return nil, errors.New("TLS options require a grpcs:// service URL")
+		}
 		creds = insecure.NewCredentials()
+	} else {
+		tlsConfig, err := NewTLSConfig(p)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
 	}
 	transportOpt := grpc.WithTransportCredentials(creds)
-	conn, err := grpc.DialContext(ctx, p.Host, transportOpt)
+	keepaliveTime := p.KeepaliveTime
+	if keepaliveTime == 0 {
+		keepaliveTime = DefaultKeepaliveTime
+	}
+	keepaliveOpt := grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:    keepaliveTime,
+		Timeout: 20 * time.Second,
+		// Servers don't allow pings without calls by default either.
+		PermitWithoutStream: false,
+	})
+	messageSizeOpt := grpc.WithDefaultCallOptions(
+		grpc.MaxCallSendMsgSize(maxMessageSize(p)),
+		grpc.MaxCallRecvMsgSize(maxMessageSize(p)),
+	)
+	opts := append([]grpc.DialOption{transportOpt, keepaliveOpt, messageSizeOpt}, telemetry.DialOptions(p.Host)...)
+	opts = append(opts, p.DialOptions...)
+	conn, err := grpc.DialContext(ctx, p.Host, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("dial %s: %w", p.Host, err)
 	}
+	telemetry.ObserveConnect(conn, p.Host)
+	return conn, nil
+}
 
-	return &Client{
-		bytestreamClient: bytestream.NewByteStreamClient(conn),
-		bitriseKVClient:  kv_storage.NewKVStorageClient(conn),
-		clientName:       p.ClientName,
-		token:            p.Token,
-	}, nil
+// Close closes the underlying connection. It is not safe to use the client
+// (or readers and writers created by it) afterwards.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Writer is returned by Client.Put.
+type Writer interface {
+	io.WriteCloser
+	// Abort ends the upload instead of Close, without storing the blob,
+	// e.g. when reading the data failed. Services which keep partial
+	// uploads, like the KVStorage one, may still offer to resume it.
+	Abort() error
 }
 
 type writer struct {
 	stream       bytestream.ByteStream_WriteClient
+	cancel       context.CancelFunc
+	tokens       TokenSource
 	resourceName string
 	offset       int64
 	fileSize     int64
+	finished     bool
+	chunkSize    int
+	buffers      *sync.Pool
 }
 
+// Write sends p in requests of at most chunkSize bytes, and nothing if p is
+// empty.
 func (w *writer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var written int
+	for {
+		chunk := p[written:min(len(p), written+w.chunkSize)]
+		if err := w.send(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		if written == len(p) {
+			return written, nil
+		}
+	}
+}
+
+// ReadFrom sends the data of r in requests of chunkSize bytes, read into a
+// buffer shared with the other writers of the client. io.Copy prefers it to
+// Write, which would send every 32KiB piece it copies in a request of its own.
+func (w *writer) ReadFrom(r io.Reader) (int64, error) {
+	buf := w.buffers.Get().(*[]byte)
+	defer w.buffers.Put(buf)
+
+	var total int64
+	for {
+		n, err := io.ReadFull(r, *buf)
+		if n > 0 {
+			// Send marshals the request, the buffer can be refilled afterwards.
+			if sendErr := w.send((*buf)[:n]); sendErr != nil {
+				return total, sendErr
+			}
+			total += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (w *writer) send(data []byte) error {
 	req := &bytestream.WriteRequest{
 		ResourceName: w.resourceName,
 		WriteOffset:  w.offset,
-		Data:         p,
-		FinishWrite:  w.offset+int64(len(p)) >= w.fileSize,
+		Data:         data,
+		FinishWrite:  w.offset+int64(len(data)) >= w.fileSize,
 	}
+	w.finished = req.FinishWrite
 	err := w.stream.Send(req)
 	switch {
 	case errors.Is(err, io.EOF):
-		return 0, io.EOF
+		// The service closed the stream, its actual status is returned by CloseAndRecv.
+		if _, recvErr := w.stream.CloseAndRecv(); recvErr != nil {
+			return fmt.Errorf("send data: %w", CheckTokenRejected(w.tokens, recvErr))
+		}
+		return io.EOF
 	case err != nil:
-		return 0, fmt.Errorf("send data: %w", err)
+		return fmt.Errorf("send data: %w", err)
 	}
-	w.offset += int64(len(p))
-	return len(p), nil
+	w.offset += int64(len(data))
+	return nil
 }
 
 func (w *writer) Close() error {
+	defer w.cancel()
+	if !w.finished {
+		// Nothing was left to send (empty blob or a fully committed resumed
+		// write), but the service still expects a finishing request.
+		req := &bytestream.WriteRequest{
+			ResourceName: w.resourceName,
+			WriteOffset:  w.offset,
+			FinishWrite:  true,
+		}
+		if err := w.stream.Send(req); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("send finish: %w", err)
+		}
+		w.finished = true
+	}
 	_, err := w.stream.CloseAndRecv()
 	if err != nil {
-		return fmt.Errorf("close stream: %w", err)
+		return fmt.Errorf("close stream: %w", CheckTokenRejected(w.tokens, err))
 	}
 	return nil
 }
 
+// Abort cancels the stream, so that the service doesn't wait for the rest of
+// the data.
+func (w *writer) Abort() error {
+	w.cancel()
+	return nil
+}
+
+// Sha256MetadataKey is the metadata key carrying the sha256 checksum of a blob,
+// both when validating uploads and when the server advertises it on reads.
+const Sha256MetadataKey = "x-flare-blob-validation-sha256"
+
+// Reader is returned by Client.Get.
+type Reader interface {
+	io.ReadCloser
+	// Sha256Sum returns the checksum the server advertised for the blob in its
+	// response headers, or an empty string if it did not send one.
+	Sha256Sum() string
+}
+
 type reader struct {
 	stream bytestream.ByteStream_ReadClient
 	buf    bytes.Buffer
+	tokens TokenSource
+	// openCompressed is set while it is still to be checked whether the
+	// blob is only stored compressed. If it is, decoder decompresses it.
+	openCompressed func() (bytestream.ByteStream_ReadClient, error)
+	decoder        *zstd.Decoder
+	header         contentHeader
 }
 
 func (r *reader) Read(p []byte) (int, error) {
+	if err := r.resolveEncoding(); err != nil {
+		return 0, err
+	}
+	if r.decoder != nil {
+		return r.decoder.Read(p)
+	}
+	return r.readRaw(p)
+}
+
+func (r *reader) readRaw(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
@@ -107,7 +346,7 @@ func (r *reader) Read(p []byte) (int, error) {
 	case errors.Is(err, io.EOF):
 		return 0, io.EOF
 	case err != nil:
-		return 0, fmt.Errorf("stream receive: %w", err)
+		return 0, fmt.Errorf("stream receive: %w", CheckTokenRejected(r.tokens, err))
 	}
 
 	n := copy(p, resp.Data)
@@ -121,7 +360,62 @@ func (r *reader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// WriteTo writes the data of each received message straight to w, without
+// copying it through a caller's buffer first. io.Copy prefers it to Read.
+func (r *reader) WriteTo(w io.Writer) (int64, error) {
+	if err := r.resolveEncoding(); err != nil {
+		return 0, err
+	}
+	if r.decoder != nil {
+		return r.decoder.WriteTo(w)
+	}
+
+	written, err := r.buf.WriteTo(w)
+	if err != nil {
+		return written, err
+	}
+
+	for {
+		resp, err := r.stream.Recv()
+		switch {
+		case errors.Is(err, io.EOF):
+			return written, nil
+		case err != nil:
+			return written, fmt.Errorf("stream receive: %w", CheckTokenRejected(r.tokens, err))
+		}
+
+		n, err := w.Write(resp.Data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if n != len(resp.Data) {
+			return written, io.ErrShortWrite
+		}
+	}
+}
+
+// Sha256Sum returns the checksum of the uncompressed content for compressed
+// blobs, once reading started.
+func (r *reader) Sha256Sum() string {
+	if r.decoder != nil {
+		return r.header.sha256
+	}
+	md, err := r.stream.Header()
+	if err != nil {
+		return ""
+	}
+	values := md.Get(Sha256MetadataKey)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
 func (r *reader) Close() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
 	r.buf.Reset()
 	return nil
 }
@@ -0,0 +1,485 @@
+package kv_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+)
+
+func TestPutGetRoundTrip(t *testing.T) {
+	server := kvtest.NewServer(t, kvtest.WithToken("token"))
+	client := server.NewClient(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(300 * 1024)
+
+	if err := kvtest.Put(ctx, client, "key", data); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	r, err := client.Get(ctx, kv.GetParams{Name: "key"})
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer r.Close()
+	// io.ReadAll starts with buffers smaller than the server's messages,
+	// which exercises the reader's buffering of the remainder.
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d matching bytes", len(got), len(data))
+	}
+	if r.Sha256Sum() != kvtest.Sha256Hex(data) {
+		t.Errorf("Sha256Sum() = %q, want %q", r.Sha256Sum(), kvtest.Sha256Hex(data))
+	}
+}
+
+func TestGetWriteTo(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	data := kvtest.RandomData(300 * 1024)
+	server.SetBlob("kv/key", data)
+
+	r, err := client.Get(context.Background(), kv.GetParams{Name: "key"})
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer r.Close()
+	// Read a little first, leaving the rest of the message buffered.
+	head := make([]byte, 1000)
+	if _, err := io.ReadFull(r, head); err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	var rest bytes.Buffer
+	n, err := r.(io.WriterTo).WriteTo(&rest)
+	if err != nil {
+		t.Fatalf("write to: %s", err)
+	}
+	if n != int64(len(data)-1000) || !bytes.Equal(append(head, rest.Bytes()...), data) {
+		t.Fatalf("got %d bytes, want %d matching bytes", 1000+n, len(data))
+	}
+}
+
+// BenchmarkGet compares copying a download through Read, as io.Copy does into
+// a writer without ReadFrom, and through WriteTo.
+func BenchmarkGet(b *testing.B) {
+	server := kvtest.NewServer(b)
+	client := server.NewClient(b)
+	data := kvtest.RandomData(16 * 1024 * 1024)
+	server.SetBlob("kv/key", data)
+
+	for _, bc := range []struct {
+		name string
+		copy func(w io.Writer, r io.Reader) (int64, error)
+	}{
+		{"Read", func(w io.Writer, r io.Reader) (int64, error) {
+			return io.Copy(w, struct{ io.Reader }{r})
+		}},
+		{"WriteTo", func(w io.Writer, r io.Reader) (int64, error) {
+			return io.Copy(w, r)
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r, err := client.Get(context.Background(), kv.GetParams{Name: "key"})
+				if err != nil {
+					b.Fatalf("get: %s", err)
+				}
+				// Hide io.Discard's ReadFrom, which would read in 8KiB pieces.
+				n, err := bc.copy(struct{ io.Writer }{io.Discard}, r)
+				r.Close()
+				if err != nil || n != int64(len(data)) {
+					b.Fatalf("copied %d bytes: %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetOffsetAndLimit(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	data := kvtest.RandomData(200 * 1024)
+	server.SetBlob("kv/key", data)
+
+	r, err := client.Get(context.Background(), kv.GetParams{Name: "key", Offset: 1000, Limit: 70000})
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !bytes.Equal(got, data[1000:71000]) {
+		t.Fatalf("got %d bytes, want bytes 1000-71000", len(got))
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+
+	r, err := client.Get(context.Background(), kv.GetParams{Name: "missing"})
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+}
+
+func TestResumePut(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(500 * 1024)
+
+	server.DisconnectAfter(100*1024, 1)
+	err := kvtest.Put(ctx, client, "key", data)
+	if !kv.IsRetryable(err) {
+		t.Fatalf("got %v, want a retryable error", err)
+	}
+
+	ws, err := client.QueryWriteStatus(ctx, "key")
+	if err != nil {
+		t.Fatalf("query write status: %s", err)
+	}
+	if ws.Complete || ws.CommittedSize < 100*1024 {
+		t.Fatalf("got %+v, want an incomplete write of at least 100KiB", ws)
+	}
+
+	if err := kvtest.PutRange(ctx, client, kv.PutParams{Name: "key", Sha256Sum: kvtest.Sha256Hex(data), FileSize: int64(len(data)), Offset: ws.CommittedSize}, data, int64(len(data))); err != nil {
+		t.Fatalf("resume put: %s", err)
+	}
+	if got, _ := server.Blob("kv/key"); !bytes.Equal(got, data) {
+		t.Fatalf("stored %d bytes, want %d matching bytes", len(got), len(data))
+	}
+}
+
+func TestPutInChunks(t *testing.T) {
+	server := kvtest.NewServer(t, kvtest.WithMaxRecvMsgSize(512*1024))
+	client := server.NewClient(t, func(p *kv.NewClientParams) {
+		p.ChunkSize = 256 * 1024
+		p.MaxMessageSize = 512 * 1024
+	})
+	ctx := context.Background()
+	data := kvtest.RandomData(1024*1024 + 5)
+
+	for _, tc := range []struct {
+		name string
+		copy func(w io.Writer) error
+	}{
+		{"ReadFrom", func(w io.Writer) error {
+			_, err := io.Copy(w, struct{ io.Reader }{bytes.NewReader(data)})
+			return err
+		}},
+		{"Write", func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}},
+		// Empty writes don't send empty requests.
+		{"EmptyWrites", func(w io.Writer) error {
+			for _, p := range [][]byte{nil, data, {}} {
+				if _, err := w.Write(p); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			messagesBefore, _ := server.PutMessages()
+			w, err := client.Put(ctx, kv.PutParams{Name: tc.name, Sha256Sum: kvtest.Sha256Hex(data), FileSize: int64(len(data))})
+			if err != nil {
+				t.Fatalf("put: %s", err)
+			}
+			if err := tc.copy(w); err != nil {
+				t.Fatalf("copy: %s", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("close: %s", err)
+			}
+
+			messages, largest := server.PutMessages()
+			if messages-messagesBefore != 5 || largest != 256*1024 {
+				t.Errorf("sent %d messages of at most %d bytes, want 5 of at most 256KiB", messages-messagesBefore, largest)
+			}
+			if got, _ := server.Blob("kv/" + tc.name); !bytes.Equal(got, data) {
+				t.Fatalf("stored %d bytes, want %d matching bytes", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestChunkSizeMustFitMessages(t *testing.T) {
+	_, err := kv.NewClient(context.Background(), kv.NewClientParams{
+		UseInsecure: true,
+		Host:        "bufnet",
+		DialTimeout: 5 * time.Second,
+		ChunkSize:   kv.DefaultMaxMessageSize,
+	})
+	if err == nil {
+		t.Fatal("got a client sending chunks as large as the message size limit")
+	}
+}
+
+func TestCompressedPut(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t, func(p *kv.NewClientParams) { p.CompressionLevel = zstd.SpeedDefault })
+	ctx := context.Background()
+	metadata := bytes.Repeat([]byte(`{"path":"DerivedData/Build/Intermediates.noindex/Foo.o","mtime":1718000000},`), 100)
+	archive := bytes.Repeat(kvtest.RandomData(1000), 3000)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		copy func(w io.Writer, data []byte) error
+	}{
+		// Fits in the sample, decided on Close.
+		{"metadata", metadata, func(w io.Writer, data []byte) error {
+			_, err := w.Write(data)
+			return err
+		}},
+		{"archive", archive, func(w io.Writer, data []byte) error {
+			_, err := io.Copy(w, struct{ io.Reader }{bytes.NewReader(data)})
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// An earlier save, stored uncompressed.
+			server.SetBlob("kv/"+tc.name, kvtest.RandomData(100))
+
+			w, err := client.Put(ctx, kv.PutParams{Name: tc.name, Sha256Sum: kvtest.Sha256Hex(tc.data), FileSize: int64(len(tc.data))})
+			if err != nil {
+				t.Fatalf("put: %s", err)
+			}
+			if err := tc.copy(w, tc.data); err != nil {
+				t.Fatalf("copy: %s", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("close: %s", err)
+			}
+			// Clients which don't decompress miss it.
+			if _, ok := server.Blob("kv/" + tc.name); ok {
+				t.Errorf("left a blob under %s", tc.name)
+			}
+			stored, _ := server.Blob("kv/" + tc.name + kv.CompressedSuffix)
+			if len(stored) >= len(tc.data)/2 {
+				t.Errorf("stored %d bytes of %d, want it compressed", len(stored), len(tc.data))
+			}
+			if got := server.Validated("kv/" + tc.name + kv.CompressedSuffix); got != kvtest.Sha256Hex(stored) {
+				t.Errorf("upload validated against %q, want the checksum of the stored bytes", got)
+			}
+
+			stat, err := client.Stat(ctx, tc.name)
+			if err != nil {
+				t.Fatalf("stat: %s", err)
+			}
+			want := kv.StatResult{Exists: true, Size: int64(len(tc.data)), Sha256Sum: kvtest.Sha256Hex(tc.data), ContentEncoding: kv.ZstdEncoding}
+			if stat != want {
+				t.Errorf("Stat() = %+v, want %+v", stat, want)
+			}
+
+			for _, read := range []struct {
+				name string
+				read func(r io.Reader) ([]byte, error)
+			}{
+				{"Read", io.ReadAll},
+				{"WriteTo", func(r io.Reader) ([]byte, error) {
+					var buf bytes.Buffer
+					_, err := io.Copy(&buf, r)
+					return buf.Bytes(), err
+				}},
+			} {
+				r, err := client.Get(ctx, kv.GetParams{Name: tc.name})
+				if err != nil {
+					t.Fatalf("get: %s", err)
+				}
+				got, err := read.read(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("%s: %s", read.name, err)
+				}
+				if !bytes.Equal(got, tc.data) || r.Sha256Sum() != kvtest.Sha256Hex(tc.data) {
+					t.Errorf("%s: got %d bytes with checksum %s, want %d matching bytes", read.name, len(got), r.Sha256Sum(), len(tc.data))
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedPutSkipsIncompressibleData(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t, func(p *kv.NewClientParams) { p.CompressionLevel = zstd.SpeedDefault })
+	ctx := context.Background()
+	data := kvtest.RandomData(3 * 1024 * 1024)
+
+	if err := kvtest.Put(ctx, client, "key", data); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if stored, _ := server.Blob("kv/key"); !bytes.Equal(stored, data) {
+		t.Fatalf("stored %d bytes, want the %d bytes as they are", len(stored), len(data))
+	}
+	stat, err := client.Stat(ctx, "key")
+	if err != nil || stat.ContentEncoding != "" || stat.Size != int64(len(data)) {
+		t.Fatalf("Stat() = %+v, %v, want an uncompressed blob", stat, err)
+	}
+
+	if _, err := client.QueryWriteStatus(ctx, "key"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("query write status: %v, want FailedPrecondition", err)
+	}
+	if _, err := client.Put(ctx, kv.PutParams{Name: "key", FileSize: 10, Offset: 5}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("resumed put: %v, want FailedPrecondition", err)
+	}
+}
+
+func TestStatDuringUpload(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(500 * 1024)
+
+	server.DisconnectAfter(100*1024, 1)
+	if err := kvtest.Put(ctx, client, "key", data); !kv.IsRetryable(err) {
+		t.Fatalf("got %v, want a retryable error", err)
+	}
+
+	// Not a miss, the service may be reporting an upload over a stored entry.
+	stat, err := client.Stat(ctx, "key")
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Stat() = %+v, %v, want FailedPrecondition", stat, err)
+	}
+}
+
+func TestStatDuringReupload(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(500 * 1024)
+	server.SetBlob("kv/key", data)
+
+	server.DisconnectAfter(100*1024, 1)
+	if err := kvtest.Put(ctx, client, "key", kvtest.RandomData(400*1024)); !kv.IsRetryable(err) {
+		t.Fatalf("got %v, want a retryable error", err)
+	}
+
+	stat, err := client.Stat(ctx, "key")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	want := kv.StatResult{Exists: true, Size: int64(len(data)), Sha256Sum: kvtest.Sha256Hex(data)}
+	if stat != want {
+		t.Fatalf("Stat() = %+v, want %+v", stat, want)
+	}
+}
+
+func TestStatAndDelete(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(1234)
+	server.SetBlob("kv/key", data)
+
+	stat, err := client.Stat(ctx, "key")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	want := kv.StatResult{Exists: true, Size: 1234, Sha256Sum: kvtest.Sha256Hex(data)}
+	if stat != want {
+		t.Fatalf("Stat() = %+v, want %+v", stat, want)
+	}
+
+	existed, err := client.Delete(ctx, "key")
+	if err != nil || !existed {
+		t.Fatalf("Delete() = %v, %v, want true, nil", existed, err)
+	}
+	existed, err = client.Delete(ctx, "key")
+	if err != nil || existed {
+		t.Fatalf("second Delete() = %v, %v, want false, nil", existed, err)
+	}
+
+	stat, err = client.Stat(ctx, "key")
+	if err != nil || stat.Exists {
+		t.Fatalf("Stat() after delete = %+v, %v, want a miss", stat, err)
+	}
+}
+
+func TestStatOfBlobUnknownToWriteStatus(t *testing.T) {
+	server := kvtest.NewServer(t, kvtest.WithUploadsOnlyWriteStatus())
+	client := server.NewClient(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(1234)
+	server.SetBlob("kv/key", data)
+
+	stat, err := client.Stat(ctx, "key")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	want := kv.StatResult{Exists: true, Size: -1, Sha256Sum: kvtest.Sha256Hex(data)}
+	if stat != want {
+		t.Fatalf("Stat() = %+v, want %+v", stat, want)
+	}
+
+	if stat, err := client.Stat(ctx, "missing"); err != nil || stat.Exists {
+		t.Fatalf("Stat() of a missing blob = %+v, %v, want a miss", stat, err)
+	}
+}
+
+func TestRetryRefreshesRejectedToken(t *testing.T) {
+	server := kvtest.NewServer(t, kvtest.WithToken("good"))
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("expired\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := kv.NewTokenSource(kv.TokenSourceParams{TokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.NewClient(t, func(p *kv.NewClientParams) { p.TokenSource = tokens })
+	server.SetBlob("kv/key", []byte("data"))
+
+	policy := kv.RetryPolicy{MaxAttempts: 2, BaseWait: time.Millisecond, MaxWait: time.Millisecond}
+	err = policy.Do(context.Background(), func(attempt int) error {
+		if attempt == 1 {
+			if err := os.WriteFile(tokenFile, []byte("good\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := client.Stat(context.Background(), "key")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("got %v, want success with the refreshed token", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for code, want := range map[codes.Code]bool{
+		codes.Unavailable:       true,
+		codes.ResourceExhausted: true,
+		codes.DeadlineExceeded:  true,
+		codes.Unauthenticated:   false,
+		codes.PermissionDenied:  false,
+		codes.NotFound:          false,
+		codes.InvalidArgument:   false,
+	} {
+		if got := kv.IsRetryable(status.Error(code, "")); got != want {
+			t.Errorf("IsRetryable(%s) = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Compressed blobs are stored under their name with CompressedSuffix, so
+// that clients which don't decompress miss them instead of reading them as
+// they are. They consist of a header describing the uncompressed content,
+// followed by a zstd stream:
+//
+//	magic (8 bytes) | size (8 bytes, big endian) | sha256 (32 bytes)
+const (
+	// CompressedSuffix is appended to the name of blobs Put compressed.
+	CompressedSuffix = ".zst"
+	// ContentEncodingMetadataKey is the metadata key carrying the encoding of
+	// an uploaded blob, if it isn't stored as it is.
+	ContentEncodingMetadataKey = "x-ddcache-content-encoding"
+	ZstdEncoding               = "zstd"
+
+	compressedHeaderSize = 48
+	// compressionSampleSize is the amount of data compressed upfront to tell
+	// whether compressing the rest is worth it.
+	compressionSampleSize = 1024 * 1024
+)
+
+var compressedMagic = []byte("DDCZSTD\x00")
+
+// ParseCompressionLevel parses "none" (or an empty string), "fastest",
+// "default", "better" or "best". None is the zero level.
+func ParseCompressionLevel(s string) (zstd.EncoderLevel, error) {
+	if s == "" || s == "none" {
+		return 0, nil
+	}
+	ok, level := zstd.EncoderLevelFromString(s)
+	if !ok {
+		return 0, fmt.Errorf("unknown compression level %q, use none, fastest, default, better or best", s)
+	}
+	return level, nil
+}
+
+type contentHeader struct {
+	size   int64
+	sha256 string
+}
+
+func encodeHeader(h contentHeader) ([]byte, bool) {
+	sum, err := hex.DecodeString(h.sha256)
+	if err != nil || len(sum) != 32 {
+		return nil, false
+	}
+	header := make([]byte, 0, compressedHeaderSize)
+	header = append(header, compressedMagic...)
+	header = binary.BigEndian.AppendUint64(header, uint64(h.size))
+	return append(header, sum...), true
+}
+
+func decodeHeader(data []byte) (contentHeader, bool) {
+	if len(data) < compressedHeaderSize || !bytes.Equal(data[:len(compressedMagic)], compressedMagic) {
+		return contentHeader{}, false
+	}
+	return contentHeader{
+		size:   int64(binary.BigEndian.Uint64(data[8:16])),
+		sha256: hex.EncodeToString(data[16:compressedHeaderSize]),
+	}, true
+}
+
+// compresses reports whether sample shrinks by at least a tenth, which
+// already compressed archives don't.
+func compresses(sample []byte, level zstd.EncoderLevel) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return false
+	}
+	defer encoder.Close()
+	return len(encoder.EncodeAll(sample, nil)) < len(sample)*9/10
+}
+
+// compressingWriter buffers the beginning of the data to decide between
+// uploading it compressed or as it is, then starts the upload, or compressing
+// it for the upload on Close.
+type compressingWriter struct {
+	ctx    context.Context
+	client *Client
+	params PutParams
+	level  zstd.EncoderLevel
+
+	sample     []byte
+	w          Writer
+	compressed bool
+	written    int64
+}
+
+func (w *compressingWriter) Write(p []byte) (int, error) {
+	var n int
+	if w.w == nil {
+		n = min(len(p), compressionSampleSize-len(w.sample))
+		w.sample = append(w.sample, p[:n]...)
+		w.written += int64(n)
+		if len(w.sample) < compressionSampleSize {
+			return n, nil
+		}
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+	m, err := w.w.Write(p[n:])
+	w.written += int64(m)
+	return n + m, err
+}
+
+// ReadFrom passes r on to the ReadFrom of the upload, once the sample is read.
+func (w *compressingWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	if w.w == nil {
+		if w.sample == nil {
+			w.sample = make([]byte, 0, compressionSampleSize)
+		}
+		n, err := io.ReadFull(r, w.sample[len(w.sample):compressionSampleSize])
+		w.sample = w.sample[:len(w.sample)+n]
+		w.written += int64(n)
+		total += int64(n)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The whole blob fits in the sample, the upload starts on Close.
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		if err := w.start(); err != nil {
+			return total, err
+		}
+	}
+	n, err := io.Copy(w.w, r)
+	w.written += n
+	return total + n, err
+}
+
+// start opens the upload, compressed if the sample compresses, and writes
+// the sample.
+func (w *compressingWriter) start() error {
+	header, ok := encodeHeader(contentHeader{size: w.params.FileSize, sha256: w.params.Sha256Sum})
+	if !ok || !compresses(w.sample, w.level) {
+		kvWriter, err := w.client.put(w.ctx, w.params, "")
+		if err != nil {
+			return err
+		}
+		w.w = kvWriter
+	} else {
+		// The service validates the size and checksum of the stored bytes,
+		// which are only known once everything is compressed: the data is
+		// compressed into a temporary file, uploaded by Close.
+		spool, err := os.CreateTemp("", "ddcache-compressed-*")
+		if err != nil {
+			return fmt.Errorf("create compression spool: %w", err)
+		}
+		sum := sha256.New()
+		buf := bufio.NewWriter(io.MultiWriter(spool, sum))
+		_, _ = buf.Write(header) // fits in the empty buffer
+		encoder, err := zstd.NewWriter(buf, zstd.WithEncoderLevel(w.level))
+		if err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			return fmt.Errorf("new zstd encoder: %w", err)
+		}
+		w.w = &zstdWriter{
+			ctx:     w.ctx,
+			client:  w.client,
+			name:    w.params.Name,
+			encoder: encoder,
+			buf:     buf,
+			spool:   spool,
+			sum:     sum,
+		}
+		w.compressed = true
+	}
+
+	sample := w.sample
+	w.sample = nil
+	if _, err := w.w.Write(sample); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (w *compressingWriter) Close() error {
+	if w.w == nil {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if w.compressed && w.written != w.params.FileSize {
+		// The service only validates the compressed data, don't let it
+		// store an incomplete blob.
+		_ = w.w.Abort()
+		return status.Errorf(codes.InvalidArgument, "wrote %d of %d bytes", w.written, w.params.FileSize)
+	}
+	return w.w.Close()
+}
+
+// Abort aborts the upload if it started already.
+func (w *compressingWriter) Abort() error {
+	w.sample = nil
+	if w.w == nil {
+		return nil
+	}
+	return w.w.Abort()
+}
+
+// zstdWriter compresses into a spool file, and uploads it under the name
+// with CompressedSuffix on Close.
+type zstdWriter struct {
+	ctx     context.Context
+	client  *Client
+	name    string
+	encoder *zstd.Encoder
+	buf     *bufio.Writer
+	spool   *os.File
+	sum     hash.Hash
+}
+
+func (w *zstdWriter) Write(p []byte) (int, error) {
+	return w.encoder.Write(p)
+}
+
+func (w *zstdWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.encoder.ReadFrom(r)
+}
+
+// Close uploads the compressed data, then removes the blob stored
+// uncompressed under the name, if any, as Get prefers it. It doesn't upload
+// anything if compressing fails, which would store the data compressed so far.
+func (w *zstdWriter) Close() error {
+	defer w.removeSpool()
+
+	if err := w.encoder.Close(); err != nil {
+		return fmt.Errorf("compress: %w", err)
+	}
+	if err := w.buf.Flush(); err != nil {
+		return fmt.Errorf("write compression spool: %w", err)
+	}
+	size, err := w.spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("seek compression spool: %w", err)
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek compression spool: %w", err)
+	}
+
+	kvWriter, err := w.client.put(w.ctx, PutParams{
+		Name:      w.name + CompressedSuffix,
+		Sha256Sum: hex.EncodeToString(w.sum.Sum(nil)),
+		FileSize:  size,
+	}, ZstdEncoding)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(kvWriter, w.spool); err != nil {
+		_ = kvWriter.Abort()
+		return err
+	}
+	if err := kvWriter.Close(); err != nil {
+		return err
+	}
+	if _, err := w.client.delete(w.ctx, w.name); err != nil {
+		return fmt.Errorf("remove uncompressed %s: %w", w.name, err)
+	}
+	return nil
+}
+
+// Abort drops the compressed data, nothing was uploaded yet.
+func (w *zstdWriter) Abort() error {
+	_ = w.encoder.Close()
+	w.removeSpool()
+	return nil
+}
+
+func (w *zstdWriter) removeSpool() {
+	_ = w.spool.Close()
+	_ = os.Remove(w.spool.Name())
+}
+
+// rawReader reads the blob of a reader as it is stored.
+type rawReader struct {
+	r *reader
+}
+
+func (r rawReader) Read(p []byte) (int, error) {
+	return r.r.readRaw(p)
+}
+
+// resolveEncoding checks, before the first read of a whole blob, whether it
+// is stored as it is or only compressed by Put, under the name with
+// CompressedSuffix. If so it switches to that blob and sets up decompressing
+// it.
+func (r *reader) resolveEncoding() error {
+	if r.openCompressed == nil {
+		return nil
+	}
+	openCompressed := r.openCompressed
+	r.openCompressed = nil
+
+	if _, err := r.peek(1); status.Code(err) != codes.NotFound {
+		return err
+	}
+	stream, err := openCompressed()
+	if err != nil {
+		return err
+	}
+	r.stream = stream
+	r.buf.Reset()
+
+	data, err := r.peek(compressedHeaderSize)
+	if err != nil {
+		return err
+	}
+	header, ok := decodeHeader(data)
+	if !ok {
+		return status.Error(codes.DataLoss, "compressed blob without a valid header")
+	}
+	r.buf.Next(compressedHeaderSize)
+	decoder, err := zstd.NewReader(rawReader{r}, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return fmt.Errorf("new zstd decoder: %w", err)
+	}
+	r.decoder = decoder
+	r.header = header
+	return nil
+}
+
+// peek receives messages until at least n bytes are buffered or the stream
+// ends, and returns the buffered bytes without consuming them.
+func (r *reader) peek(n int) ([]byte, error) {
+	for r.buf.Len() < n {
+		resp, err := r.stream.Recv()
+		switch {
+		case errors.Is(err, io.EOF):
+			return r.buf.Bytes(), nil
+		case err != nil:
+			return nil, fmt.Errorf("stream receive: %w", CheckTokenRejected(r.tokens, err))
+		}
+		r.buf.Write(resp.Data)
+	}
+	return r.buf.Bytes(), nil
+}
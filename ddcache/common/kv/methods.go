@@ -7,25 +7,62 @@ import (
 	"io"
 
 	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type PutParams struct {
 	Name      string
 	Sha256Sum string
 	FileSize  int64
+	// Offset is the number of bytes the service has already committed for
+	// this write, as reported by QueryWriteStatus. The returned writer
+	// continues the upload from there.
+	Offset int64
 }
 
-func (c *Client) Put(ctx context.Context, p PutParams) (io.WriteCloser, error) {
+// Put returns a writer uploading p.FileSize bytes under p.Name. When the
+// client compresses, the blob may be stored compressed under p.Name with
+// CompressedSuffix instead, see NewClientParams.CompressionLevel.
+func (c *Client) Put(ctx context.Context, p PutParams) (Writer, error) {
+	if c.compression == 0 {
+		return c.put(ctx, p, "")
+	}
+	if p.Offset != 0 {
+		return nil, status.Error(codes.FailedPrecondition, "compressed uploads can't be resumed")
+	}
+	return &compressingWriter{
+		ctx:    ctx,
+		client: c,
+		params: p,
+		level:  c.compression,
+	}, nil
+}
+
+// put uploads the data as it is written, which is encoded with encoding if
+// not empty.
+func (c *Client) put(ctx context.Context, p PutParams, encoding string) (*writer, error) {
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
 	md := metadata.Pairs(
-		"authorization", fmt.Sprintf("bearer %s", c.token),
-		"x-flare-blob-validation-sha256", p.Sha256Sum,
-		"x-flare-blob-validation-level", "error",
+		"authorization", fmt.Sprintf("bearer %s", token),
 		"x-flare-no-skip-duplicate-writes", "true",
 	)
-	ctx = metadata.NewOutgoingContext(ctx, md)
+	if p.Sha256Sum != "" {
+		md.Append(Sha256MetadataKey, p.Sha256Sum)
+		md.Append("x-flare-blob-validation-level", "error")
+	}
+	if encoding != "" {
+		md.Append(ContentEncodingMetadataKey, encoding)
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
 	stream, err := c.bitriseKVClient.Put(ctx)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("initiate put: %w", err)
 	}
 
@@ -33,29 +70,239 @@ func (c *Client) Put(ctx context.Context, p PutParams) (io.WriteCloser, error) {
 
 	return &writer{
 		stream:       stream,
+		cancel:       cancel,
+		tokens:       c.tokens,
 		resourceName: resourceName,
-		offset:       0,
+		offset:       p.Offset,
 		fileSize:     p.FileSize,
+		chunkSize:    c.chunkSize,
+		buffers:      &c.buffers,
+	}, nil
+}
+
+type WriteStatus struct {
+	CommittedSize int64
+	Complete      bool
+}
+
+// QueryWriteStatus reports how many bytes of the named entry the service has
+// committed so far, which lets an interrupted Put be continued from there.
+// It fails when the client compresses, as compressed uploads start over.
+func (c *Client) QueryWriteStatus(ctx context.Context, name string) (WriteStatus, error) {
+	if c.compression != 0 {
+		return WriteStatus{}, status.Error(codes.FailedPrecondition, "compressed uploads can't be resumed")
+	}
+	resp, err := c.queryWriteStatus(ctx, name)
+	if err != nil {
+		return WriteStatus{}, fmt.Errorf("query write status: %w", err)
+	}
+
+	return WriteStatus{
+		CommittedSize: resp.GetCommittedSize(),
+		Complete:      resp.GetComplete(),
 	}, nil
 }
 
-func (c *Client) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+type StatResult struct {
+	Exists bool
+	// Size is -1 if the backend doesn't know it, e.g. an HTTP cache which
+	// sent no Content-Length.
+	Size int64
+	// Sha256Sum is the checksum advertised by the service, empty if it sent none.
+	Sha256Sum string
+	// ContentEncoding is ZstdEncoding for blobs Put compressed, in which case
+	// Size and Sha256Sum describe the uncompressed content. Ranges of such
+	// blobs can't be read on their own.
+	ContentEncoding string
+}
+
+// Stat reports whether the named entry exists and how big it is without
+// starting to read it. Entries only stored compressed are described by the
+// header of the compressed blob.
+//
+// The service is expected to report a stored entry as complete, even while it
+// is being uploaded again. An incomplete write status is reported as a
+// FailedPrecondition error rather than a miss, so that callers find out with
+// Get whether an entry is stored, in case the service reports the upload
+// instead. Services may also only know the status of writes in progress, so
+// an unknown write status is confirmed with Get before reporting a miss.
+func (c *Client) Stat(ctx context.Context, name string) (StatResult, error) {
+	result, err := c.stat(ctx, name)
+	if err != nil || result.Exists {
+		return result, err
+	}
+	result, err = c.stat(ctx, name+CompressedSuffix)
+	if err != nil || !result.Exists {
+		return result, err
+	}
+	return c.statCompressed(ctx, name+CompressedSuffix)
+}
+
+func (c *Client) stat(ctx context.Context, name string) (StatResult, error) {
+	var header metadata.MD
+	resp, err := c.queryWriteStatus(ctx, name, grpc.Header(&header))
+	switch {
+	case status.Code(err) == codes.NotFound:
+		return c.statWithGet(ctx, name)
+	case err != nil:
+		return StatResult{}, fmt.Errorf("stat: %w", err)
+	case !resp.GetComplete():
+		return StatResult{}, status.Errorf(codes.FailedPrecondition, "stat: an upload of %s is in progress", name)
+	}
+
+	result := StatResult{
+		Exists: true,
+		Size:   resp.GetCommittedSize(),
+	}
+	if values := header.Get(Sha256MetadataKey); len(values) > 0 {
+		result.Sha256Sum = values[0]
+	}
+	return result, nil
+}
+
+// statWithGet reports whether the named entry exists by reading its first
+// byte. Its size is unknown.
+func (c *Client) statWithGet(ctx context.Context, name string) (StatResult, error) {
+	r, err := c.Get(ctx, GetParams{Name: name, Limit: 1})
+	if err == nil {
+		defer r.Close()
+		_, err = io.Copy(io.Discard, r)
+	}
+	switch {
+	case status.Code(err) == codes.NotFound:
+		return StatResult{}, nil
+	case err != nil:
+		return StatResult{}, fmt.Errorf("stat: %w", err)
+	}
+	return StatResult{Exists: true, Size: -1, Sha256Sum: r.Sha256Sum()}, nil
+}
+
+// statCompressed describes the uncompressed content of the named compressed
+// blob, read from its header.
+func (c *Client) statCompressed(ctx context.Context, name string) (StatResult, error) {
+	r, err := c.Get(ctx, GetParams{Name: name, Limit: compressedHeaderSize})
+	if err != nil {
+		return StatResult{}, fmt.Errorf("stat: %w", err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return StatResult{}, fmt.Errorf("stat: %w", err)
+	}
+	header, ok := decodeHeader(data)
+	if !ok {
+		return StatResult{}, status.Errorf(codes.DataLoss, "stat: %s has no valid compression header", name)
+	}
+	return StatResult{
+		Exists:          true,
+		Size:            header.size,
+		Sha256Sum:       header.sha256,
+		ContentEncoding: ZstdEncoding,
+	}, nil
+}
+
+func (c *Client) queryWriteStatus(ctx context.Context, name string, opts ...grpc.CallOption) (*bytestream.QueryWriteStatusResponse, error) {
 	resourceName := fmt.Sprintf("%s/%s", c.clientName, name)
 
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	md := metadata.Pairs("authorization", fmt.Sprintf("Bearer %s", token))
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	resp, err := c.bytestreamClient.QueryWriteStatus(ctx, &bytestream.QueryWriteStatusRequest{
+		ResourceName: resourceName,
+	}, opts...)
+	if err != nil {
+		return nil, CheckTokenRejected(c.tokens, err)
+	}
+	return resp, nil
+}
+
+type GetParams struct {
+	Name string
+	// Offset is the position in the blob from which to start reading.
+	Offset int64
+	// Limit is the maximum number of bytes to read, 0 means no limit.
+	Limit int64
+}
+
+// Get reads the range of p of the named entry. Whole entries only stored
+// compressed are decompressed, see Put.
+func (c *Client) Get(ctx context.Context, p GetParams) (Reader, error) {
+	stream, err := c.get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{
+		stream: stream,
+		buf:    bytes.Buffer{},
+		tokens: c.tokens,
+	}
+	if p.Offset == 0 && p.Limit == 0 {
+		// Only whole blobs can be decompressed.
+		r.openCompressed = func() (bytestream.ByteStream_ReadClient, error) {
+			return c.get(ctx, GetParams{Name: p.Name + CompressedSuffix})
+		}
+	}
+	return r, nil
+}
+
+func (c *Client) get(ctx context.Context, p GetParams) (bytestream.ByteStream_ReadClient, error) {
+	resourceName := fmt.Sprintf("%s/%s", c.clientName, p.Name)
+
 	readReq := &bytestream.ReadRequest{
 		ResourceName: resourceName,
-		ReadOffset:   0,
-		ReadLimit:    0,
+		ReadOffset:   p.Offset,
+		ReadLimit:    p.Limit,
 	}
-	md := metadata.Pairs("authorization", fmt.Sprintf("Bearer %s", c.token))
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	md := metadata.Pairs("authorization", fmt.Sprintf("Bearer %s", token))
 	ctx = metadata.NewOutgoingContext(ctx, md)
 	stream, err := c.bitriseKVClient.Get(ctx, readReq)
 	if err != nil {
 		return nil, fmt.Errorf("initiate get: %w", err)
 	}
+	return stream, nil
+}
 
-	return &reader{
-		stream: stream,
-		buf:    bytes.Buffer{},
-	}, nil
+// Delete removes the named entry, whether it is stored compressed or not. It
+// reports whether the entry existed.
+func (c *Client) Delete(ctx context.Context, name string) (bool, error) {
+	existed, err := c.delete(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	compressedExisted, err := c.delete(ctx, name+CompressedSuffix)
+	if err != nil {
+		return false, err
+	}
+	return existed || compressedExisted, nil
+}
+
+func (c *Client) delete(ctx context.Context, name string) (bool, error) {
+	resourceName := fmt.Sprintf("%s/%s", c.clientName, name)
+
+	readReq := &bytestream.ReadRequest{
+		ResourceName: resourceName,
+	}
+	token, err := c.tokens.Token(ctx)
+	if err != nil {
+		return false, err
+	}
+	md := metadata.Pairs("authorization", fmt.Sprintf("Bearer %s", token))
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	resp, err := c.bitriseKVClient.Delete(ctx, readReq)
+	switch {
+	case status.Code(err) == codes.NotFound:
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("delete: %w", CheckTokenRejected(c.tokens, err))
+	}
+
+	return resp.GetOk() != 0, nil
 }
@@ -0,0 +1,141 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type GetParallelParams struct {
+	Name string
+	// Size is the total size of the blob, e.g. as reported by QueryWriteStatus.
+	Size int64
+	// Concurrency is the number of ranges fetched at the same time.
+	Concurrency int
+	// RetryPolicy retries each range on its own, continuing from where it
+	// broke, so that a failing range doesn't restart the whole download.
+	// The zero value doesn't retry.
+	RetryPolicy RetryPolicy
+}
+
+// Getter reads ranges of blobs, e.g. a Client.
+type Getter interface {
+	Get(ctx context.Context, p GetParams) (Reader, error)
+}
+
+// GetParallel downloads a blob of known size by splitting it into
+// p.Concurrency ranges which are fetched concurrently from g and written into
+// dst at their offsets. dst should already be sized to p.Size (e.g. with
+// os.File.Truncate). It returns the checksum advertised by the service, if any.
+// It fails with Aborted if the service advertised different checksums for the
+// ranges, as the blob changed meanwhile.
+func GetParallel(ctx context.Context, g Getter, dst io.WriterAt, p GetParallelParams) (string, error) {
+	concurrency := int64(p.Concurrency)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > p.Size {
+		concurrency = max(p.Size, 1)
+	}
+	rangeSize := (p.Size + concurrency - 1) / concurrency
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		once      sync.Once
+		firstErr  error
+		mu        sync.Mutex
+		checksums = map[string]bool{}
+	)
+	for i := int64(0); i < concurrency; i++ {
+		offset := i * rangeSize
+		limit := min(rangeSize, p.Size-offset)
+		if limit <= 0 {
+			break
+		}
+
+		wg.Add(1)
+		go func(offset, limit int64) {
+			defer wg.Done()
+
+			var received int64
+			err := p.RetryPolicy.Do(ctx, func(int) error {
+				sum, n, err := getRange(ctx, g, dst, p.Name, offset+received, limit-received)
+				received += n
+				if sum != "" {
+					mu.Lock()
+					checksums[sum] = true
+					mu.Unlock()
+				}
+				return err
+			})
+			if err != nil {
+				once.Do(func() {
+					firstErr = fmt.Errorf("range %d-%d: %w", offset, offset+limit, err)
+					cancel()
+				})
+			}
+		}(offset, limit)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return "", firstErr
+	}
+	if len(checksums) > 1 {
+		return "", status.Error(codes.Aborted, "the blob changed during the download")
+	}
+	for checksum := range checksums {
+		return checksum, nil
+	}
+	return "", nil
+}
+
+// getRange copies limit bytes from offset of the named blob into dst. It
+// returns the checksum advertised by the service, and how many bytes it
+// copied, even if it fails.
+func getRange(ctx context.Context, g Getter, dst io.WriterAt, name string, offset, limit int64) (string, int64, error) {
+	r, err := g.Get(ctx, GetParams{
+		Name:   name,
+		Offset: offset,
+		Limit:  limit,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+
+	w := &rangeWriter{dst: io.NewOffsetWriter(dst, offset), remaining: limit}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return r.Sha256Sum(), n, err
+	}
+	if n != limit {
+		return r.Sha256Sum(), n, fmt.Errorf("received %d of %d bytes: %w", n, limit, io.ErrUnexpectedEOF)
+	}
+	return r.Sha256Sum(), n, nil
+}
+
+// rangeWriter writes a range of dst, and fails instead of writing past its
+// end into the neighbouring range. Unlike limiting the reader, it keeps the
+// reader's WriterTo usable by io.Copy.
+type rangeWriter struct {
+	dst       *io.OffsetWriter
+	remaining int64
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remaining {
+		return 0, errors.New("received more than the requested bytes")
+	}
+	n, err := w.dst.Write(p)
+	w.remaining -= int64(n)
+	return n, err
+}
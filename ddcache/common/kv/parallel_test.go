@@ -0,0 +1,112 @@
+package kv_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+)
+
+// recordingGetter records the ranges requested from a Getter.
+type recordingGetter struct {
+	kv.Getter
+	mu     sync.Mutex
+	params []kv.GetParams
+}
+
+func (g *recordingGetter) Get(ctx context.Context, p kv.GetParams) (kv.Reader, error) {
+	g.mu.Lock()
+	g.params = append(g.params, p)
+	g.mu.Unlock()
+	return g.Getter.Get(ctx, p)
+}
+
+func newSizedFile(t *testing.T, size int64) *os.File {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	if err := file.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestGetParallelRetriesFailedRange(t *testing.T) {
+	server := kvtest.NewServer(t)
+	getter := &recordingGetter{Getter: server.NewClient(t)}
+	data := kvtest.RandomData(1024 * 1024)
+	server.SetBlob("kv/key", data)
+	server.DisconnectAfter(100*1024, 1)
+	file := newSizedFile(t, int64(len(data)))
+
+	checksum, err := kv.GetParallel(context.Background(), getter, file, kv.GetParallelParams{
+		Name:        "key",
+		Size:        int64(len(data)),
+		Concurrency: 4,
+		RetryPolicy: kv.RetryPolicy{MaxAttempts: 2},
+	})
+	if err != nil {
+		t.Fatalf("get parallel: %s", err)
+	}
+	got, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || checksum != kvtest.Sha256Hex(data) {
+		t.Fatalf("got %d bytes with checksum %s, want %d matching bytes", len(got), checksum, len(data))
+	}
+
+	// Only the broken range was requested again, from where it broke.
+	if len(getter.params) != 5 {
+		t.Fatalf("requested ranges %+v, want the 4 ranges and a retry", getter.params)
+	}
+	if retry := getter.params[4]; retry.Offset%(256*1024) == 0 || retry.Offset%(256*1024)+retry.Limit != 256*1024 {
+		t.Errorf("retried range %+v, want the rest of a range", retry)
+	}
+}
+
+// checksumGetter serves zeros, advertising a different checksum for ranges
+// past the first one, as if the blob had been replaced meanwhile.
+type checksumGetter struct{}
+
+func (checksumGetter) Get(_ context.Context, p kv.GetParams) (kv.Reader, error) {
+	sum := "first"
+	if p.Offset > 0 {
+		sum = "second"
+	}
+	return checksumReader{Reader: bytes.NewReader(make([]byte, p.Limit)), sha256: sum}, nil
+}
+
+type checksumReader struct {
+	io.Reader
+	sha256 string
+}
+
+func (r checksumReader) Close() error      { return nil }
+func (r checksumReader) Sha256Sum() string { return r.sha256 }
+
+func TestGetParallelDetectsChangedBlob(t *testing.T) {
+	file := newSizedFile(t, 1024)
+
+	_, err := kv.GetParallel(context.Background(), checksumGetter{}, file, kv.GetParallelParams{
+		Name:        "key",
+		Size:        1024,
+		Concurrency: 2,
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("got %v, want Aborted", err)
+	}
+}
@@ -0,0 +1,93 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/telemetry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy retries transient failures with exponential backoff and jitter.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseWait is the wait before the first retry, doubled on every retry.
+	BaseWait time.Duration
+	// MaxWait caps the wait between two attempts.
+	MaxWait time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseWait:    time.Second,
+	MaxWait:     30 * time.Second,
+}
+
+// IsRetryable reports whether err is worth retrying: the service is
+// unavailable, overloaded or timed out, or the stream broke mid-transfer.
+// Authentication (unless a fresh token can be fetched), permission,
+// missing-key and invalid-request failures are not.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var rejected tokenRejectedError
+	if errors.As(err, &rejected) {
+		// The token was dropped and a fresh one will be fetched.
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted, codes.Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// Do calls fn until it succeeds, fails with an error IsRetryable rejects, the
+// attempts run out or ctx is done, and returns fn's last error. attempt starts at 0.
+// Retries are recorded by the telemetry package.
+func (p RetryPolicy) Do(ctx context.Context, fn func(attempt int) error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || !IsRetryable(err) || attempt+1 >= p.MaxAttempts {
+			return err
+		}
+		telemetry.RecordRetry(ctx, attempt, err)
+
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.BaseWait
+	for i := 0; i < attempt && (p.MaxWait <= 0 || wait < p.MaxWait); i++ {
+		wait *= 2
+	}
+	if p.MaxWait > 0 && wait > p.MaxWait {
+		wait = p.MaxWait
+	}
+	if wait <= 0 {
+		return 0
+	}
+
+	// Equal jitter: wait at least half of the backoff so that retries keep
+	// spreading out, randomize the rest so that clients don't retry in lockstep.
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1))
+}
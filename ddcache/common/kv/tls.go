@@ -0,0 +1,42 @@
+package kv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// NewTLSConfig returns the TLS configuration for the CA bundle, client
+// certificate and server name options of p.
+func NewTLSConfig(p NewClientParams) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: p.ServerName,
+	}
+
+	if p.CACertPath != "" {
+		pem, err := os.ReadFile(p.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %q contains no PEM certificates", p.CACertPath)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (p.ClientCertPath == "") != (p.ClientKeyPath == "") {
+		return nil, errors.New("client certificate and client key must be provided together")
+	}
+	if p.ClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(p.ClientCertPath, p.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate %q and key %q: %w", p.ClientCertPath, p.ClientKeyPath, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
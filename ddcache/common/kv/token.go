@@ -0,0 +1,154 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	TokenEnvVar            = "DDCACHE_ACCESS_TOKEN"
+	TokenFileEnvVar        = "DDCACHE_ACCESS_TOKEN_FILE"
+	CredentialHelperEnvVar = "DDCACHE_CREDENTIAL_HELPER"
+)
+
+// TokenSource provides the access token sent with every request.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+	// Invalidate drops the cached token after the service rejected it. It
+	// reports whether calling Token again may yield a different token.
+	Invalidate() bool
+}
+
+type TokenSourceParams struct {
+	// Token is an explicitly provided token, e.g. from a command line flag.
+	Token string
+	// TokenFile is a file containing the token, $DDCACHE_ACCESS_TOKEN_FILE if empty.
+	TokenFile string
+	// CredentialHelper is a shell command printing the token to stdout,
+	// $DDCACHE_CREDENTIAL_HELPER if empty.
+	CredentialHelper string
+}
+
+// NewTokenSource resolves where the token comes from, in order: the explicit
+// token, $DDCACHE_ACCESS_TOKEN, the token file, then the credential helper.
+// Only the first configured source is used.
+func NewTokenSource(p TokenSourceParams) (TokenSource, error) {
+	if p.Token != "" {
+		return StaticToken(p.Token), nil
+	}
+	if token := os.Getenv(TokenEnvVar); token != "" {
+		return StaticToken(token), nil
+	}
+
+	tokenFile := p.TokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv(TokenFileEnvVar)
+	}
+	if tokenFile != "" {
+		return &cachingTokenSource{fetch: func(context.Context) ([]byte, error) {
+			return os.ReadFile(tokenFile)
+		}}, nil
+	}
+
+	helper := p.CredentialHelper
+	if helper == "" {
+		helper = os.Getenv(CredentialHelperEnvVar)
+	}
+	if helper != "" {
+		return &cachingTokenSource{fetch: func(ctx context.Context) ([]byte, error) {
+			return runCredentialHelper(ctx, helper)
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("no access token: provide one with --access-token, $%s, a token file or a credential helper", TokenEnvVar)
+}
+
+// StaticToken is a token which never changes.
+type StaticToken string
+
+func (t StaticToken) Token(context.Context) (string, error) {
+	return string(t), nil
+}
+
+func (t StaticToken) Invalidate() bool {
+	return false
+}
+
+// cachingTokenSource fetches the token once and keeps it until it is invalidated.
+type cachingTokenSource struct {
+	fetch func(ctx context.Context) ([]byte, error)
+
+	mu    sync.Mutex
+	token string
+}
+
+func (s *cachingTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" {
+		return s.token, nil
+	}
+	out, err := s.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetch access token: %w", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", errors.New("fetch access token: empty token")
+	}
+	s.token = token
+	return token, nil
+}
+
+func (s *cachingTokenSource) Invalidate() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+	return true
+}
+
+func runCredentialHelper(ctx context.Context, command string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential helper: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// tokenRejectedError is an Unauthenticated failure after which the rejected
+// token was dropped, so a retry fetches a fresh one.
+type tokenRejectedError struct {
+	err error
+}
+
+func (e tokenRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e tokenRejectedError) Unwrap() error {
+	return e.err
+}
+
+// CheckTokenRejected invalidates the token when err is Unauthenticated and
+// marks err retryable if a different token may be obtained. Backends outside
+// this package call it with their failures mapped to status errors.
+func CheckTokenRejected(tokens TokenSource, err error) error {
+	if status.Code(err) != codes.Unauthenticated || !tokens.Invalidate() {
+		return err
+	}
+	return tokenRejectedError{err: err}
+}
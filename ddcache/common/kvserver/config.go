@@ -0,0 +1,106 @@
+package kvserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// Config is read from the server's JSON config file.
+type Config struct {
+	// Tokens are the bearer tokens clients may authenticate with. If empty,
+	// every request is accepted.
+	Tokens []string `json:"tokens"`
+
+	Eviction EvictionPolicy `json:"eviction"`
+}
+
+// EvictionPolicy configures which blobs are removed from the store, e.g.:
+//
+//	"eviction": {
+//	  "max_size": "200GB",
+//	  "interval": "5m",
+//	  "ttls": {"kv/chunk-": "168h", "kv/": "720h"}
+//	}
+type EvictionPolicy struct {
+	// MaxSize is the total size of the stored blobs; above it the least
+	// recently accessed blobs are evicted. Zero means no quota.
+	MaxSize ByteSize `json:"max_size"`
+	// TTLs maps namespaces, i.e. resource name prefixes, to how long a blob
+	// is kept after it was last accessed. The longest matching prefix wins,
+	// blobs without a matching prefix don't expire.
+	TTLs map[string]Duration `json:"ttls"`
+	// Interval is how often eviction runs, DefaultEvictionInterval if zero.
+	Interval Duration `json:"interval"`
+}
+
+const DefaultEvictionInterval = 5 * time.Minute
+
+// Enabled reports whether the policy evicts anything at all.
+func (p EvictionPolicy) Enabled() bool {
+	return p.MaxSize > 0 || len(p.TTLs) > 0
+}
+
+// TTL returns the TTL of the namespace of name, zero if it has none.
+func (p EvictionPolicy) TTL(name string) time.Duration {
+	var longest string
+	var ttl Duration
+	for prefix, t := range p.TTLs {
+		if strings.HasPrefix(name, prefix) && len(prefix) >= len(longest) {
+			longest, ttl = prefix, t
+		}
+	}
+	return time.Duration(ttl)
+}
+
+// ByteSize is a size given as a string such as "50GB" or "1.5 TiB".
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a string: %w", err)
+	}
+	size, err := humanize.ParseBytes(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(size)
+	return nil
+}
+
+// Duration is a duration given as a string such as "72h" or "30m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if duration < 0 {
+		return fmt.Errorf("negative duration %s", s)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("read config: %w", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("parse config %q: %w", path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,169 @@
+package kvserver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// abandonedUploadAge is how long an unfinished upload is kept around for
+// resuming after it was last written to.
+const abandonedUploadAge = 24 * time.Hour
+
+// Evicted describes a blob removed by Evict.
+type Evicted struct {
+	Name       string
+	Size       int64
+	AccessedAt time.Time
+	// Reason is "expired" or "quota".
+	Reason string
+}
+
+type candidate struct {
+	name string
+	entry
+}
+
+// Evict removes the blobs that are expired according to policy at now, then
+// the least recently accessed ones until the total size is within the quota.
+// The store is only locked while a blob is removed, so Get and Put are not
+// held up by a whole eviction pass.
+func (s *Store) Evict(policy EvictionPolicy, now time.Time) ([]Evicted, error) {
+	var candidates []candidate
+	var total int64
+	s.mu.Lock()
+	for name, e := range s.index {
+		candidates = append(candidates, candidate{name: name, entry: *e})
+		total += e.size
+	}
+	s.mu.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accessedAt.Before(candidates[j].accessedAt)
+	})
+
+	var evicted []Evicted
+	evict := func(c candidate, reason string) error {
+		removed, err := s.removeIfUnused(c)
+		if err != nil || !removed {
+			return err
+		}
+		total -= c.size
+		evicted = append(evicted, Evicted{Name: c.name, Size: c.size, AccessedAt: c.accessedAt, Reason: reason})
+		return nil
+	}
+
+	var kept []candidate
+	for _, c := range candidates {
+		if ttl := policy.TTL(c.name); ttl > 0 && now.Sub(c.accessedAt) > ttl {
+			if err := evict(c, "expired"); err != nil {
+				return evicted, err
+			}
+			continue
+		}
+		kept = append(kept, c)
+	}
+
+	if policy.MaxSize > 0 {
+		for _, c := range kept {
+			if total <= int64(policy.MaxSize) {
+				break
+			}
+			if err := evict(c, "quota"); err != nil {
+				return evicted, err
+			}
+		}
+	}
+
+	return evicted, s.removeAbandonedUploads(now)
+}
+
+// removeIfUnused removes the blob of c unless it was accessed or replaced
+// since c was taken from the index.
+func (s *Store) removeIfUnused(c candidate) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.index[c.name]
+	if !ok || *e != c.entry || s.uploading[c.name] {
+		return false, nil
+	}
+	return true, s.remove(c.name)
+}
+
+func (s *Store) removeAbandonedUploads(now time.Time) error {
+	entries, err := os.ReadDir(s.uploadsDir)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inProgress := map[string]bool{}
+	for name := range s.uploading {
+		inProgress[fileID(name)] = true
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || inProgress[e.Name()] || now.Sub(info.ModTime()) < abandonedUploadAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.uploadsDir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunEviction evicts according to policy every policy.Interval, until ctx is
+// done.
+func (s *Store) RunEviction(ctx context.Context, policy EvictionPolicy, logger log.Logger) {
+	interval := time.Duration(policy.Interval)
+	if interval == 0 {
+		interval = DefaultEvictionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		evicted, err := s.Evict(policy, now)
+		var size int64
+		for _, e := range evicted {
+			logger.Infof("Evicted %s - size %s, last accessed %s ago (%s)",
+				e.Name, humanize.Bytes(uint64(e.Size)), now.Sub(e.AccessedAt).Round(time.Second), e.Reason)
+			size += e.Size
+		}
+		if len(evicted) > 0 {
+			logger.Infof("Evicted %d blobs - size %s, %s stored", len(evicted), humanize.Bytes(uint64(size)), humanize.Bytes(uint64(s.Size())))
+		}
+		if err != nil {
+			logger.Errorf("Eviction failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Size returns the total size of the stored blobs.
+func (s *Store) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for _, e := range s.index {
+		total += e.size
+	}
+	return total
+}
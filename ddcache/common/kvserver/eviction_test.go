@@ -0,0 +1,97 @@
+package kvserver_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvserver"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+)
+
+func storeBlob(t *testing.T, store *kvserver.Store, name string, size int) {
+	t.Helper()
+
+	upload, err := store.StartUpload(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upload.Close()
+	if _, err := upload.Write(kvtest.RandomData(size)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.Commit(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func evictedNames(evicted []kvserver.Evicted) []string {
+	var names []string
+	for _, e := range evicted {
+		names = append(names, e.Name+" "+e.Reason)
+	}
+	return names
+}
+
+func assertStored(t *testing.T, store *kvserver.Store, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		if _, err := store.Stat(name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestEvictExpired(t *testing.T) {
+	store := newTestStore(t)
+	storeBlob(t, store, "kv/chunk-1", 100)
+	storeBlob(t, store, "kv/main-archive", 100)
+	policy := kvserver.EvictionPolicy{
+		TTLs: map[string]kvserver.Duration{
+			"kv/":       kvserver.Duration(24 * time.Hour),
+			"kv/chunk-": kvserver.Duration(time.Hour),
+		},
+	}
+
+	evicted, err := store.Evict(policy, time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := evictedNames(evicted); len(got) != 1 || got[0] != "kv/chunk-1 expired" {
+		t.Fatalf("evicted %v, want [kv/chunk-1 expired]", got)
+	}
+	assertStored(t, store, "kv/main-archive")
+}
+
+func TestEvictLeastRecentlyAccessedAboveQuota(t *testing.T) {
+	dir := t.TempDir()
+	store, err := kvserver.NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"kv/a", "kv/b", "kv/c"} {
+		storeBlob(t, store, name, 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Access times are persisted, so a restarted server evicts the same blobs.
+	store, err = kvserver.NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := store.Size(); size != 300 {
+		t.Fatalf("indexed %d bytes, want 300", size)
+	}
+
+	evicted, err := store.Evict(kvserver.EvictionPolicy{MaxSize: 150}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := evictedNames(evicted); len(got) != 2 || got[0] != "kv/a quota" || got[1] != "kv/b quota" {
+		t.Fatalf("evicted %v, want [kv/a quota kv/b quota]", got)
+	}
+	assertStored(t, store, "kv/c")
+	if size := store.Size(); size != 100 {
+		t.Errorf("%d bytes left, want 100", size)
+	}
+}
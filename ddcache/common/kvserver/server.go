@@ -0,0 +1,235 @@
+// Package kvserver implements the KVStorage service on top of a local
+// directory, so that ddcache-save and ddcache-restore can be used with a
+// self-hosted cache.
+package kvserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/proto/kv_storage"
+)
+
+const (
+	validationLevelMetadataKey = "x-flare-blob-validation-level"
+	noSkipDuplicatesKey        = "x-flare-no-skip-duplicate-writes"
+
+	readChunkSize = 256 * 1024
+)
+
+// Server serves the KVStorage service and the QueryWriteStatus method of the
+// ByteStream service (used for Stat and resumable uploads) from a Store.
+type Server struct {
+	kv_storage.UnimplementedKVStorageServer
+	bytestream.UnimplementedByteStreamServer
+
+	store  *Store
+	tokens []string
+	logger log.Logger
+}
+
+func NewServer(store *Store, config Config, logger log.Logger) *Server {
+	return &Server{
+		store:  store,
+		tokens: config.Tokens,
+		logger: logger,
+	}
+}
+
+// Register registers the services on registrar.
+func (s *Server) Register(registrar *grpc.Server) {
+	kv_storage.RegisterKVStorageServer(registrar, s)
+	bytestream.RegisterByteStreamServer(registrar, s)
+}
+
+func (s *Server) Get(req *bytestream.ReadRequest, stream kv_storage.KVStorage_GetServer) error {
+	if err := s.authorize(stream.Context()); err != nil {
+		return err
+	}
+
+	name := req.GetResourceName()
+	file, meta, err := s.store.Open(name)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer file.Close()
+
+	offset := req.GetReadOffset()
+	if offset < 0 || offset > meta.Size {
+		return status.Errorf(codes.OutOfRange, "offset %d out of range for size %d", offset, meta.Size)
+	}
+	remaining := meta.Size - offset
+	if limit := req.GetReadLimit(); limit > 0 && limit < remaining {
+		remaining = limit
+	}
+
+	if err := stream.SendHeader(metadata.Pairs(kv.Sha256MetadataKey, meta.Sha256)); err != nil {
+		return err
+	}
+	s.logger.Debugf("Get %s offset %d length %d", name, offset, remaining)
+
+	buf := make([]byte, readChunkSize)
+	for remaining > 0 {
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), remaining)], offset)
+		if n > 0 {
+			if err := stream.Send(&bytestream.ReadResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+			offset += int64(n)
+			remaining -= int64(n)
+		}
+		if err != nil && !(errors.Is(err, io.EOF) && remaining == 0) {
+			return status.Errorf(codes.Internal, "read %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) Put(stream kv_storage.KVStorage_PutServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx); err != nil {
+		return err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var upload *Upload
+	defer func() {
+		if upload != nil {
+			upload.Close()
+		}
+	}()
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return status.Error(codes.InvalidArgument, "stream closed without finish_write")
+		}
+		if err != nil {
+			return err
+		}
+
+		if upload == nil {
+			name := req.GetResourceName()
+			if name == "" {
+				return status.Error(codes.InvalidArgument, "missing resource name")
+			}
+			if firstValue(md, noSkipDuplicatesKey) != "true" {
+				if meta, err := s.store.Stat(name); err == nil {
+					s.logger.Debugf("Put %s skipped, already stored", name)
+					return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: meta.Size})
+				}
+			}
+
+			upload, err = s.store.StartUpload(name, req.GetWriteOffset())
+			if err != nil {
+				return toStatus(err)
+			}
+			s.logger.Debugf("Put %s from offset %d", name, req.GetWriteOffset())
+		}
+
+		if req.GetWriteOffset() != upload.Size() {
+			return status.Errorf(codes.InvalidArgument, "write offset %d, expected %d", req.GetWriteOffset(), upload.Size())
+		}
+		if _, err := upload.Write(req.GetData()); err != nil {
+			return status.Errorf(codes.Internal, "write: %s", err)
+		}
+
+		if req.GetFinishWrite() {
+			var expected string
+			if firstValue(md, validationLevelMetadataKey) == "error" {
+				expected = firstValue(md, kv.Sha256MetadataKey)
+			}
+			meta, err := upload.Commit(expected)
+			if err != nil {
+				return toStatus(err)
+			}
+			s.logger.Infof("Stored %s - size %d", meta.Name, meta.Size)
+			return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: meta.Size})
+		}
+	}
+}
+
+func (s *Server) Delete(ctx context.Context, req *bytestream.ReadRequest) (*kv_storage.DeleteResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.Delete(req.GetResourceName()); err != nil {
+		return nil, toStatus(err)
+	}
+	s.logger.Infof("Deleted %s", req.GetResourceName())
+	return &kv_storage.DeleteResponse{Ok: 1}, nil
+}
+
+func (s *Server) QueryWriteStatus(ctx context.Context, req *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	// A stored blob is complete, even while it is being uploaded again, or
+	// an abandoned upload of it is left behind. Restores would miss it
+	// otherwise.
+	name := req.GetResourceName()
+	meta, err := s.store.Stat(name)
+	if errors.Is(err, ErrNotFound) {
+		if size, ok := s.store.UploadSize(name); ok {
+			return &bytestream.QueryWriteStatusResponse{CommittedSize: size}, nil
+		}
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(kv.Sha256MetadataKey, meta.Sha256)); err != nil {
+		return nil, err
+	}
+	return &bytestream.QueryWriteStatusResponse{CommittedSize: meta.Size, Complete: true}, nil
+}
+
+func (s *Server) authorize(ctx context.Context) error {
+	if len(s.tokens) == 0 {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	scheme, token, _ := strings.Cut(firstValue(md, "authorization"), " ")
+	if strings.EqualFold(scheme, "bearer") {
+		for _, allowed := range s.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+				return nil
+			}
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing bearer token")
+}
+
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrUploadInProgress):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, ErrOffsetMismatch), errors.Is(err, ErrChecksumMismatch):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func firstValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
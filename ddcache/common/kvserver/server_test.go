@@ -0,0 +1,195 @@
+package kvserver_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvserver"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+)
+
+// serve serves a kvserver on top of store until the test finishes.
+func serve(t *testing.T, store *kvserver.Store, config kvserver.Config) []grpc.DialOption {
+	t.Helper()
+
+	return kvtest.Serve(t, kvserver.NewServer(store, config, log.NewLogger()).Register)
+}
+
+func newTestStore(t *testing.T) *kvserver.Store {
+	t.Helper()
+
+	store, err := kvserver.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func get(ctx context.Context, client *kv.Client, name string) ([]byte, string, error) {
+	r, err := client.Get(ctx, kv.GetParams{Name: name})
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, r.Sha256Sum(), nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	client := kvtest.NewClient(t, serve(t, newTestStore(t), kvserver.Config{}))
+	ctx := context.Background()
+	data := kvtest.RandomData(1024*1024 + 3)
+
+	if err := kvtest.Put(ctx, client, "main-archive", data); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	got, sum, err := get(ctx, client, "main-archive")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d matching bytes", len(got), len(data))
+	}
+	if want := kvtest.Sha256Hex(data); sum != want {
+		t.Errorf("got sha256 %s, want %s", sum, want)
+	}
+
+	stat, err := client.Stat(ctx, "main-archive")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	if !stat.Exists || stat.Size != int64(len(data)) || stat.Sha256Sum != sum {
+		t.Errorf("got stat %+v", stat)
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	store := newTestStore(t)
+	client := kvtest.NewClient(t, serve(t, store, kvserver.Config{}))
+	ctx := context.Background()
+	data := kvtest.RandomData(512 * 1024)
+
+	// Upload the first half on a stream which is cancelled once the server
+	// stored it.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := kvtest.PutRange(cancelCtx, client, kv.PutParams{Name: "main-archive", Sha256Sum: kvtest.Sha256Hex(data), FileSize: int64(len(data))}, data, 256*1024); err != nil {
+		t.Fatalf("partial put: %s", err)
+	}
+
+	var writeStatus kv.WriteStatus
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		writeStatus, _ = client.QueryWriteStatus(ctx, "main-archive")
+		if writeStatus.CommittedSize == 256*1024 {
+			break
+		}
+	}
+	if writeStatus.Complete || writeStatus.CommittedSize != 256*1024 {
+		t.Fatalf("got write status %+v, want a partial upload", writeStatus)
+	}
+	cancel()
+
+	// The upload is only released once the server noticed the cancellation.
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		writeStatus, _ = client.QueryWriteStatus(ctx, "main-archive")
+		if err = kvtest.PutRange(ctx, client, kv.PutParams{Name: "main-archive", Sha256Sum: kvtest.Sha256Hex(data), FileSize: int64(len(data)), Offset: writeStatus.CommittedSize}, data, int64(len(data))); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("resume put: %s", err)
+	}
+
+	got, _, err := get(ctx, client, "main-archive")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d matching bytes", len(got), len(data))
+	}
+}
+
+func TestStatWithStaleUpload(t *testing.T) {
+	store := newTestStore(t)
+	client := kvtest.NewClient(t, serve(t, store, kvserver.Config{}))
+	ctx := context.Background()
+	data := kvtest.RandomData(1024)
+	if err := kvtest.Put(ctx, client, "main-archive", data); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	// Abandon an upload of the key once the server stored some of it.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stale := kvtest.RandomData(512 * 1024)
+	if err := kvtest.PutRange(cancelCtx, client, kv.PutParams{Name: "main-archive", Sha256Sum: kvtest.Sha256Hex(stale), FileSize: int64(len(stale))}, stale, 256*1024); err != nil {
+		t.Fatalf("partial put: %s", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if size, _ := store.UploadSize("kv/main-archive"); size == 256*1024 {
+			break
+		}
+	}
+	cancel()
+	if size, ok := store.UploadSize("kv/main-archive"); !ok || size != 256*1024 {
+		t.Fatalf("upload size %d, %t, want a partial upload", size, ok)
+	}
+
+	writeStatus, err := client.QueryWriteStatus(ctx, "main-archive")
+	if err != nil || !writeStatus.Complete || writeStatus.CommittedSize != int64(len(data)) {
+		t.Fatalf("got write status %+v, %v, want the stored blob", writeStatus, err)
+	}
+	stat, err := client.Stat(ctx, "main-archive")
+	if err != nil || !stat.Exists || stat.Size != int64(len(data)) || stat.Sha256Sum != kvtest.Sha256Hex(data) {
+		t.Fatalf("got stat %+v, %v, want the stored blob", stat, err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	client := kvtest.NewClient(t, serve(t, newTestStore(t), kvserver.Config{}))
+	ctx := context.Background()
+
+	if err := kvtest.Put(ctx, client, "main-archive", kvtest.RandomData(1024)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if deleted, err := client.Delete(ctx, "main-archive"); err != nil || !deleted {
+		t.Fatalf("delete: %t, %v", deleted, err)
+	}
+	if deleted, err := client.Delete(ctx, "main-archive"); err != nil || deleted {
+		t.Fatalf("second delete: %t, %v", deleted, err)
+	}
+	if _, _, err := get(ctx, client, "main-archive"); status.Code(err) != codes.NotFound {
+		t.Fatalf("get after delete: %v, want NotFound", err)
+	}
+}
+
+func TestRejectsUnknownToken(t *testing.T) {
+	store := newTestStore(t)
+	config := kvserver.Config{Tokens: []string{"secret"}}
+	ctx := context.Background()
+
+	dialOptions := serve(t, store, config)
+	client := kvtest.NewClient(t, dialOptions, func(p *kv.NewClientParams) { p.Token = "wrong" })
+	if _, err := client.Stat(ctx, "main-archive"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("stat with wrong token: %v, want Unauthenticated", err)
+	}
+
+	client = kvtest.NewClient(t, dialOptions, func(p *kv.NewClientParams) { p.Token = "secret" })
+	if err := kvtest.Put(ctx, client, "main-archive", kvtest.RandomData(1024)); err != nil {
+		t.Fatalf("put with valid token: %s", err)
+	}
+}
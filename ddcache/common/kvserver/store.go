@@ -0,0 +1,358 @@
+package kvserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/util"
+)
+
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrUploadInProgress = errors.New("another upload of the same key is in progress")
+	ErrOffsetMismatch   = errors.New("write offset does not match the uploaded size")
+	ErrChecksumMismatch = errors.New("sha256 checksum mismatch")
+)
+
+// Meta describes a stored blob.
+type Meta struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Store keeps blobs in a directory. Blob files are named after the sha256 of
+// the resource name (resource names may contain slashes and be arbitrarily
+// long), with a JSON sidecar holding the metadata. Unfinished uploads are
+// kept in a separate directory so that they can be resumed.
+//
+// The size and last access time of every blob is indexed in memory for
+// eviction. Access times are persisted as the modification time of the blob
+// files, so they survive restarts.
+type Store struct {
+	blobsDir   string
+	uploadsDir string
+
+	mu        sync.Mutex
+	uploading map[string]bool
+	index     map[string]*entry
+}
+
+type entry struct {
+	size       int64
+	accessedAt time.Time
+}
+
+// accessTimeResolution limits how often reading a blob updates its access
+// time on disk.
+const accessTimeResolution = time.Minute
+
+func NewStore(dir string) (*Store, error) {
+	s := &Store{
+		blobsDir:   filepath.Join(dir, "blobs"),
+		uploadsDir: filepath.Join(dir, "uploads"),
+		uploading:  map[string]bool{},
+		index:      map[string]*entry{},
+	}
+	for _, d := range []string{s.blobsDir, s.uploadsDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, fmt.Errorf("create %q: %w", d, err)
+		}
+	}
+	if err := s.loadIndex(); err != nil {
+		return nil, fmt.Errorf("index %q: %w", s.blobsDir, err)
+	}
+	return s, nil
+}
+
+func (s *Store) loadIndex() error {
+	metaPaths, err := filepath.Glob(filepath.Join(s.blobsDir, "*.meta"))
+	if err != nil {
+		return err
+	}
+	for _, metaPath := range metaPaths {
+		data, err := os.ReadFile(metaPath)
+		if err != nil {
+			return err
+		}
+		var meta Meta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return fmt.Errorf("unmarshal %s: %w", metaPath, err)
+		}
+		info, err := os.Stat(s.dataPath(meta.Name))
+		if errors.Is(err, os.ErrNotExist) {
+			// Interrupted commit or removal, the metadata is all that's left.
+			_ = os.Remove(metaPath)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.index[meta.Name] = &entry{size: meta.Size, accessedAt: info.ModTime()}
+	}
+	return nil
+}
+
+func fileID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) dataPath(name string) string {
+	return filepath.Join(s.blobsDir, fileID(name)+".data")
+}
+
+func (s *Store) metaPath(name string) string {
+	return filepath.Join(s.blobsDir, fileID(name)+".meta")
+}
+
+func (s *Store) uploadPath(name string) string {
+	return filepath.Join(s.uploadsDir, fileID(name))
+}
+
+// Stat returns the metadata of a stored blob, ErrNotFound if there is none.
+func (s *Store) Stat(name string) (Meta, error) {
+	data, err := os.ReadFile(s.metaPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return Meta{}, ErrNotFound
+	}
+	if err != nil {
+		return Meta{}, err
+	}
+
+	var meta Meta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return Meta{}, fmt.Errorf("unmarshal metadata of %s: %w", name, err)
+	}
+	return meta, nil
+}
+
+// Open opens a stored blob for reading, and records the access.
+func (s *Store) Open(name string) (*os.File, Meta, error) {
+	file, meta, err := s.open(name)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	s.touch(name)
+	return file, meta, nil
+}
+
+// open holds the lock so that the metadata and the data come from the same
+// commit, as Commit replaces them one after the other.
+func (s *Store) open(name string) (*os.File, Meta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, err := s.Stat(name)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	file, err := os.Open(s.dataPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, Meta{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	return file, meta, nil
+}
+
+func (s *Store) touch(name string) {
+	now := time.Now()
+
+	s.mu.Lock()
+	e, ok := s.index[name]
+	if !ok || now.Sub(e.accessedAt) < accessTimeResolution {
+		s.mu.Unlock()
+		return
+	}
+	e.accessedAt = now
+	s.mu.Unlock()
+
+	// Best effort, at worst the blob is evicted a little early after a restart.
+	_ = os.Chtimes(s.dataPath(name), now, now)
+}
+
+// UploadSize returns the size of an unfinished upload.
+func (s *Store) UploadSize(name string) (int64, bool) {
+	info, err := os.Stat(s.uploadPath(name))
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// Delete removes a stored blob and any unfinished upload of it. It returns
+// ErrNotFound if neither existed.
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(name)
+}
+
+// remove must be called with s.mu held.
+func (s *Store) remove(name string) error {
+	delete(s.index, name)
+	errUpload := os.Remove(s.uploadPath(name))
+	errMeta := os.Remove(s.metaPath(name))
+	errData := os.Remove(s.dataPath(name))
+	for _, err := range []error{errUpload, errMeta, errData} {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if errUpload != nil && errMeta != nil && errData != nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// StartUpload starts writing name at offset: 0 starts over, anything else
+// must match the size of the unfinished upload. Only one upload of a name
+// can be in progress at a time.
+func (s *Store) StartUpload(name string, offset int64) (*Upload, error) {
+	s.mu.Lock()
+	if s.uploading[name] {
+		s.mu.Unlock()
+		return nil, ErrUploadInProgress
+	}
+	s.uploading[name] = true
+	s.mu.Unlock()
+
+	u, err := s.openUpload(name, offset)
+	if err != nil {
+		s.release(name)
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Store) openUpload(name string, offset int64) (*Upload, error) {
+	path := s.uploadPath(name)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0o644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrOffsetMismatch
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() != offset {
+		file.Close()
+		return nil, ErrOffsetMismatch
+	}
+
+	return &Upload{
+		store: s,
+		name:  name,
+		file:  file,
+		size:  offset,
+	}, nil
+}
+
+func (s *Store) release(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.uploading, name)
+}
+
+// Upload is an upload in progress. It must be closed, whether or not it was
+// committed; closing an uncommitted upload keeps the data for resuming.
+type Upload struct {
+	store  *Store
+	name   string
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+func (u *Upload) Write(p []byte) (int, error) {
+	n, err := u.file.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+// Size is the number of bytes uploaded so far, including earlier attempts.
+func (u *Upload) Size() int64 {
+	return u.size
+}
+
+// Commit makes the upload the stored blob of its name. If expectedSha256 is
+// set and does not match the content, the upload is discarded.
+func (u *Upload) Commit(expectedSha256 string) (Meta, error) {
+	if err := u.file.Sync(); err != nil {
+		return Meta{}, fmt.Errorf("sync upload: %w", err)
+	}
+	sum, err := util.ChecksumOfFile(u.store.uploadPath(u.name))
+	if err != nil {
+		return Meta{}, fmt.Errorf("checksum upload: %w", err)
+	}
+	if expectedSha256 != "" && sum != expectedSha256 {
+		_ = u.file.Close()
+		u.closed = true
+		_ = os.Remove(u.store.uploadPath(u.name))
+		u.store.release(u.name)
+		return Meta{}, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expectedSha256, sum)
+	}
+
+	meta := Meta{
+		Name:   u.name,
+		Size:   u.size,
+		Sha256: sum,
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return Meta{}, err
+	}
+	tmpMetaPath := u.store.metaPath(u.name) + ".tmp"
+	if err := os.WriteFile(tmpMetaPath, metaData, 0o644); err != nil {
+		return Meta{}, fmt.Errorf("write metadata: %w", err)
+	}
+
+	// Hold the lock so that eviction never sees the new blob half committed.
+	u.store.mu.Lock()
+	defer u.store.mu.Unlock()
+	if err := os.Rename(u.store.uploadPath(u.name), u.store.dataPath(u.name)); err != nil {
+		return Meta{}, fmt.Errorf("commit data: %w", err)
+	}
+	if err := os.Rename(tmpMetaPath, u.store.metaPath(u.name)); err != nil {
+		return Meta{}, fmt.Errorf("commit metadata: %w", err)
+	}
+	u.store.index[u.name] = &entry{size: meta.Size, accessedAt: time.Now()}
+
+	return meta, u.close()
+}
+
+func (u *Upload) Close() error {
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+	defer u.store.release(u.name)
+	return u.file.Close()
+}
+
+// close is Close with u.store.mu held.
+func (u *Upload) close() error {
+	u.closed = true
+	delete(u.store.uploading, u.name)
+	return u.file.Close()
+}
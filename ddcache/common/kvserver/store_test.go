@@ -0,0 +1,41 @@
+package kvserver_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+)
+
+func TestOpenDuringCommit(t *testing.T) {
+	store := newTestStore(t)
+	storeBlob(t, store, "kv/main-archive", 1024)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			storeBlob(t, store, "kv/main-archive", 1024+i%2*1024)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		file, meta, err := store.Open("kv/main-archive")
+		if err != nil {
+			t.Fatalf("open: %s", err)
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) != meta.Size || kvtest.Sha256Hex(data) != meta.Sha256 {
+			t.Fatalf("opened %d bytes described as %+v", len(data), meta)
+		}
+	}
+}
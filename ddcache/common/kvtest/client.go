@@ -0,0 +1,97 @@
+package kvtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+)
+
+// ClientOption adjusts the parameters of the clients created by NewClient.
+type ClientOption func(*kv.NewClientParams)
+
+// NewClient returns a client of the service dialed with dialOptions, e.g.
+// the ones returned by Serve, which is closed when the test finishes. It
+// uses the "kv" client name and the "token" access token by default.
+func NewClient(tb testing.TB, dialOptions []grpc.DialOption, opts ...ClientOption) *kv.Client {
+	tb.Helper()
+
+	params := kv.NewClientParams{
+		UseInsecure: true,
+		Host:        "bufnet",
+		DialTimeout: 5 * time.Second,
+		ClientName:  "kv",
+		Token:       "token",
+		DialOptions: dialOptions,
+	}
+	for _, opt := range opts {
+		opt(&params)
+	}
+	client, err := kv.NewClient(context.Background(), params)
+	if err != nil {
+		tb.Fatalf("new client: %s", err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return client
+}
+
+// NewClient returns a client of s, see the NewClient function.
+func (s *Server) NewClient(tb testing.TB, opts ...ClientOption) *kv.Client {
+	tb.Helper()
+
+	return NewClient(tb, s.DialOptions(), opts...)
+}
+
+// RandomData returns size pseudo-random bytes, the same for the same size.
+func RandomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// Sha256Hex returns the checksum of data, as advertised by the service.
+func Sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Putter uploads blobs, like kv.Client and the storage backends.
+type Putter interface {
+	Put(ctx context.Context, p kv.PutParams) (kv.Writer, error)
+}
+
+// Put uploads data under name with its checksum.
+func Put(ctx context.Context, putter Putter, name string, data []byte) error {
+	return PutRange(ctx, putter, kv.PutParams{
+		Name:      name,
+		Sha256Sum: Sha256Hex(data),
+		FileSize:  int64(len(data)),
+	}, data, int64(len(data)))
+}
+
+// PutRange uploads data[p.Offset:end] of the blob data described by p. If
+// end is before the end of data, the upload is abandoned without closing it,
+// like by a client which lost its connection.
+func PutRange(ctx context.Context, putter Putter, p kv.PutParams, data []byte, end int64) error {
+	w, err := putter.Put(ctx, p)
+	if err != nil {
+		return err
+	}
+	// Hide bytes.Reader's WriterTo and the writer's ReaderFrom so that
+	// io.Copy writes in small pieces.
+	if _, err := io.Copy(struct{ io.Writer }{w}, struct{ io.Reader }{bytes.NewReader(data[p.Offset:end])}); err != nil {
+		return err
+	}
+	if end < int64(len(data)) {
+		return nil
+	}
+	return w.Close()
+}
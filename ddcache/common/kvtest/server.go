@@ -0,0 +1,454 @@
+// Package kvtest provides an in-memory KVStorage service for tests, served
+// over an in-process connection, with knobs to inject failures.
+package kvtest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/proto/kv_storage"
+)
+
+const (
+	sha256MetadataKey          = "x-flare-blob-validation-sha256"
+	validationLevelMetadataKey = "x-flare-blob-validation-level"
+	noSkipDuplicatesKey        = "x-flare-no-skip-duplicate-writes"
+
+	bufSize   = 1024 * 1024
+	chunkSize = 64 * 1024
+)
+
+// Server implements the KVStorage service, and the QueryWriteStatus method of
+// the ByteStream service, on top of an in-memory map. Blobs are keyed by their
+// full resource name, e.g. "kv/<key>".
+type Server struct {
+	kv_storage.UnimplementedKVStorageServer
+	bytestream.UnimplementedByteStreamServer
+
+	dialOptions   []grpc.DialOption
+	serverOptions []grpc.ServerOption
+	token         string
+
+	uploadsOnlyWriteStatus bool
+
+	mu              sync.Mutex
+	blobs           map[string]blob
+	pending         map[string][]byte
+	validated       map[string]string
+	puts            int
+	putMessages     int
+	largestMessage  int
+	latency         time.Duration
+	disconnectAfter int64
+	disconnects     int
+	failures        []codes.Code
+	corrupt         bool
+}
+
+type blob struct {
+	data   []byte
+	sha256 string
+}
+
+type Option func(*Server)
+
+// WithToken makes the server reject requests without "Bearer <token>" authorization.
+func WithToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// WithUploadsOnlyWriteStatus makes QueryWriteStatus only know uploads in
+// progress, and report stored blobs as not found, like ByteStream services
+// which forget about finished writes.
+func WithUploadsOnlyWriteStatus() Option {
+	return func(s *Server) {
+		s.uploadsOnlyWriteStatus = true
+	}
+}
+
+// WithMaxRecvMsgSize makes the server reject messages larger than n bytes.
+func WithMaxRecvMsgSize(n int) Option {
+	return func(s *Server) {
+		s.serverOptions = append(s.serverOptions, grpc.MaxRecvMsgSize(n))
+	}
+}
+
+// NewServer starts a server which is stopped when the test finishes.
+func NewServer(tb testing.TB, opts ...Option) *Server {
+	tb.Helper()
+
+	s := &Server{
+		blobs:     map[string]blob{},
+		pending:   map[string][]byte{},
+		validated: map[string]string{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.dialOptions = Serve(tb, func(grpcServer *grpc.Server) {
+		kv_storage.RegisterKVStorageServer(grpcServer, s)
+		bytestream.RegisterByteStreamServer(grpcServer, s)
+	}, s.serverOptions...)
+	return s
+}
+
+// Serve serves the services registered by register over an in-process
+// connection until the test finishes. It returns the options connecting a
+// client to it, whatever host it dials.
+func Serve(tb testing.TB, register func(*grpc.Server), opts ...grpc.ServerOption) []grpc.DialOption {
+	tb.Helper()
+
+	listener := bufconn.Listen(bufSize)
+	grpcServer := grpc.NewServer(opts...)
+	register(grpcServer)
+	go grpcServer.Serve(listener) //nolint:errcheck
+	tb.Cleanup(grpcServer.Stop)
+
+	return []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	}
+}
+
+// DialOptions connect a client to the server, whatever host it dials.
+func (s *Server) DialOptions() []grpc.DialOption {
+	return s.dialOptions
+}
+
+// SetBlob stores data under resourceName, as if it had been uploaded.
+func (s *Server) SetBlob(resourceName string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs[resourceName] = newBlob(data)
+}
+
+// SetPending keeps data as an interrupted upload of resourceName, as if a
+// client had lost its connection after sending it.
+func (s *Server) SetPending(resourceName string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending[resourceName] = data
+}
+
+// Blob returns the data stored under resourceName.
+func (s *Server) Blob(resourceName string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blobs[resourceName]
+	return b.data, ok
+}
+
+// Validated returns the checksum the last upload of a blob was validated
+// against, empty if it wasn't.
+func (s *Server) Validated(resourceName string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.validated[resourceName]
+}
+
+// Puts returns the number of completed uploads.
+func (s *Server) Puts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.puts
+}
+
+// PutMessages returns the number of messages received by Put streams, and the
+// size of the largest data among them.
+func (s *Server) PutMessages() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.putMessages, s.largestMessage
+}
+
+// SetLatency delays every streamed message by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = d
+}
+
+// DisconnectAfter makes the next times Get or Put streams fail with
+// Unavailable once they have transferred n bytes. Data received by a broken
+// Put is kept, so the upload can be resumed.
+func (s *Server) DisconnectAfter(n int64, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.disconnectAfter = n
+	s.disconnects = times
+}
+
+// FailNext makes the next n requests fail with code.
+func (s *Server) FailNext(code codes.Code, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, code)
+	}
+}
+
+// SetCorrupt makes Get flip a bit in every message it sends.
+func (s *Server) SetCorrupt(corrupt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.corrupt = corrupt
+}
+
+func (s *Server) Get(req *bytestream.ReadRequest, stream kv_storage.KVStorage_GetServer) error {
+	if err := s.check(stream.Context()); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	b, ok := s.blobs[req.GetResourceName()]
+	corrupt := s.corrupt
+	s.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "%s not found", req.GetResourceName())
+	}
+
+	size := int64(len(b.data))
+	offset := req.GetReadOffset()
+	if offset < 0 || offset > size {
+		return status.Errorf(codes.OutOfRange, "offset %d out of range for size %d", offset, size)
+	}
+	end := size
+	if limit := req.GetReadLimit(); limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+
+	if err := stream.SendHeader(metadata.Pairs(sha256MetadataKey, b.sha256)); err != nil {
+		return err
+	}
+
+	disconnectAfter := s.takeDisconnect()
+	var sent int64
+	for off := offset; off < end; off += chunkSize {
+		if disconnectAfter >= 0 && sent >= disconnectAfter {
+			return status.Error(codes.Unavailable, "injected disconnect")
+		}
+		s.sleep()
+
+		data := b.data[off:min(off+chunkSize, end)]
+		if corrupt {
+			data = append([]byte{}, data...)
+			data[0] ^= 0x01
+		}
+		if err := stream.Send(&bytestream.ReadResponse{Data: data}); err != nil {
+			return err
+		}
+		sent += int64(len(data))
+	}
+	return nil
+}
+
+func (s *Server) Put(stream kv_storage.KVStorage_PutServer) error {
+	ctx := stream.Context()
+	if err := s.check(ctx); err != nil {
+		return err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	noSkipDuplicates := firstValue(md, noSkipDuplicatesKey) == "true"
+
+	disconnectAfter := s.takeDisconnect()
+	var resourceName string
+	var buf []byte
+	var received int64
+	finished := false
+	defer func() {
+		if resourceName != "" && !finished {
+			s.mu.Lock()
+			s.pending[resourceName] = buf
+			s.mu.Unlock()
+		}
+	}()
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return status.Error(codes.InvalidArgument, "stream closed without finish_write")
+		}
+		if err != nil {
+			return err
+		}
+
+		if resourceName == "" {
+			resourceName = req.GetResourceName()
+			if resourceName == "" {
+				return status.Error(codes.InvalidArgument, "missing resource name")
+			}
+
+			s.mu.Lock()
+			existing, exists := s.blobs[resourceName]
+			if req.GetWriteOffset() > 0 {
+				buf = s.pending[resourceName]
+			}
+			s.mu.Unlock()
+
+			if exists && !noSkipDuplicates {
+				finished = true
+				return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(len(existing.data))})
+			}
+		}
+		if req.GetWriteOffset() != int64(len(buf)) {
+			return status.Errorf(codes.InvalidArgument, "write offset %d, expected %d", req.GetWriteOffset(), len(buf))
+		}
+
+		s.sleep()
+		s.mu.Lock()
+		s.putMessages++
+		s.largestMessage = max(s.largestMessage, len(req.GetData()))
+		s.mu.Unlock()
+		buf = append(buf, req.GetData()...)
+		received += int64(len(req.GetData()))
+		if disconnectAfter >= 0 && received >= disconnectAfter && !req.GetFinishWrite() {
+			return status.Error(codes.Unavailable, "injected disconnect")
+		}
+
+		if req.GetFinishWrite() {
+			break
+		}
+	}
+
+	b := newBlob(buf)
+	expected := firstValue(md, sha256MetadataKey)
+	if expected != "" && firstValue(md, validationLevelMetadataKey) == "error" && expected != b.sha256 {
+		return status.Errorf(codes.InvalidArgument, "sha256 mismatch: expected %s, got %s", expected, b.sha256)
+	}
+
+	finished = true
+	s.mu.Lock()
+	s.blobs[resourceName] = b
+	delete(s.pending, resourceName)
+	if expected != "" && firstValue(md, validationLevelMetadataKey) == "error" {
+		s.validated[resourceName] = expected
+	} else {
+		delete(s.validated, resourceName)
+	}
+	s.puts++
+	s.mu.Unlock()
+
+	return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(len(buf))})
+}
+
+func (s *Server) Delete(ctx context.Context, req *bytestream.ReadRequest) (*kv_storage.DeleteResponse, error) {
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blobs[req.GetResourceName()]; !ok {
+		return nil, status.Errorf(codes.NotFound, "%s not found", req.GetResourceName())
+	}
+	delete(s.blobs, req.GetResourceName())
+	return &kv_storage.DeleteResponse{Ok: 1}, nil
+}
+
+func (s *Server) QueryWriteStatus(ctx context.Context, req *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A stored blob is complete, even while it is being uploaded again.
+	b, ok := s.blobs[req.GetResourceName()]
+	if !ok || s.uploadsOnlyWriteStatus {
+		if pending, ok := s.pending[req.GetResourceName()]; ok {
+			return &bytestream.QueryWriteStatusResponse{CommittedSize: int64(len(pending))}, nil
+		}
+		return nil, status.Errorf(codes.NotFound, "%s not found", req.GetResourceName())
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(sha256MetadataKey, b.sha256)); err != nil {
+		return nil, err
+	}
+	return &bytestream.QueryWriteStatusResponse{CommittedSize: int64(len(b.data)), Complete: true}, nil
+}
+
+// check authorizes the request and applies injected failures.
+func (s *Server) check(ctx context.Context) error {
+	if s.token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		scheme, token, _ := strings.Cut(firstValue(md, "authorization"), " ")
+		if !strings.EqualFold(scheme, "bearer") || token != s.token {
+			return status.Error(codes.Unauthenticated, "invalid token")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.failures) > 0 {
+		code := s.failures[0]
+		s.failures = s.failures[1:]
+		return status.Error(code, "injected failure")
+	}
+	return nil
+}
+
+// takeDisconnect returns after how many bytes the calling stream should
+// break, or -1 if it should not.
+func (s *Server) takeDisconnect() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.disconnects == 0 {
+		return -1
+	}
+	s.disconnects--
+	return s.disconnectAfter
+}
+
+func (s *Server) sleep() {
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
+
+func newBlob(data []byte) blob {
+	return blob{
+		data:   data,
+		sha256: Sha256Hex(data),
+	}
+}
+
+func firstValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
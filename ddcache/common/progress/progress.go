@@ -0,0 +1,222 @@
+// Package progress logs the progress of uploads and downloads, so that a
+// stalled transfer can be told apart from a slow one in CI logs.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+)
+
+const (
+	// TerminalInterval is the time between two progress lines on a terminal.
+	TerminalInterval = time.Second
+	// LogInterval is the time between two progress lines otherwise, which
+	// keeps CI logs readable.
+	LogInterval = 30 * time.Second
+)
+
+// Tracker counts the bytes of a transfer and logs its progress at most once
+// per interval. It is safe for concurrent use, e.g. by the ranges of a
+// parallel download.
+type Tracker struct {
+	logger   log.Logger
+	action   string
+	name     string
+	total    int64
+	interval time.Duration
+	now      func() time.Time
+	start    time.Time
+
+	done    atomic.Int64
+	skipped atomic.Int64
+
+	mu         sync.Mutex
+	lastReport time.Time
+	lastDone   int64
+}
+
+// New returns a tracker of a transfer of total bytes (0 if unknown), which
+// logs lines like "<action> <name>: 1.2 GB of 5.0 GB (24%), 45 MB/s, ETA 1m25s".
+func New(logger log.Logger, action, name string, total int64) *Tracker {
+	interval := LogInterval
+	if isTerminal(os.Stdout) {
+		interval = TerminalInterval
+	}
+	return newTracker(logger, action, name, total, interval, time.Now)
+}
+
+func newTracker(logger log.Logger, action, name string, total int64, interval time.Duration, now func() time.Time) *Tracker {
+	start := now()
+	return &Tracker{
+		logger:     logger,
+		action:     action,
+		name:       name,
+		total:      total,
+		interval:   interval,
+		now:        now,
+		start:      start,
+		lastReport: start,
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Add counts n transferred bytes.
+func (t *Tracker) Add(n int64) {
+	t.done.Add(n)
+	t.report()
+}
+
+// Skip counts n bytes which didn't need transferring, e.g. chunks the service
+// or the local chunk cache already has. They don't count towards throughput.
+func (t *Tracker) Skip(n int64) {
+	t.skipped.Add(n)
+	t.done.Add(n)
+	t.report()
+}
+
+// Restart sets the progress to offset, when a retry resumes from there or
+// starts over.
+func (t *Tracker) Restart(offset int64) {
+	t.done.Store(offset + t.skipped.Load())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastDone = min(t.lastDone, t.done.Load())
+}
+
+func (t *Tracker) report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	elapsed := now.Sub(t.lastReport)
+	if elapsed < t.interval {
+		return
+	}
+	done := t.done.Load()
+	rate := float64(done-t.lastDone) / elapsed.Seconds()
+	t.lastReport = now
+	t.lastDone = done
+
+	if t.total <= 0 {
+		t.logger.Infof("%s %s: %s, %s/s", t.action, t.name, humanize.Bytes(uint64(done)), humanize.Bytes(uint64(rate)))
+		return
+	}
+	eta := "unknown"
+	if average := float64(done-t.skipped.Load()) / now.Sub(t.start).Seconds(); average > 0 {
+		remaining := time.Duration(float64(t.total-done) / average * float64(time.Second))
+		eta = remaining.Round(time.Second).String()
+	}
+	t.logger.Infof("%s %s: %s of %s (%d%%), %s/s, ETA %s",
+		t.action, t.name, humanize.Bytes(uint64(done)), humanize.Bytes(uint64(t.total)),
+		done*100/t.total, humanize.Bytes(uint64(rate)), eta)
+}
+
+// Done logs the duration and the average throughput of the transfer under
+// summary, e.g. "Uploaded".
+func (t *Tracker) Done(summary string) {
+	duration := t.now().Sub(t.start)
+	transferred := t.done.Load() - t.skipped.Load()
+	line := fmt.Sprintf("%s %s - %s in %s (%s/s)", summary, t.name,
+		humanize.Bytes(uint64(transferred)), duration.Round(time.Millisecond),
+		humanize.Bytes(uint64(float64(transferred)/max(duration.Seconds(), 0.001))))
+	if skipped := t.skipped.Load(); skipped > 0 {
+		line += fmt.Sprintf(", %s skipped", humanize.Bytes(uint64(skipped)))
+	}
+	t.logger.Infof("%s", line)
+}
+
+// Writer counts the bytes written to w. It keeps the io.ReaderFrom of w.
+func (t *Tracker) Writer(w io.WriteCloser) io.WriteCloser {
+	return &writer{w: w, tracker: t}
+}
+
+// Reader counts the bytes read from r. It keeps the io.WriterTo of r.
+func (t *Tracker) Reader(r kv.Reader) kv.Reader {
+	return &reader{Reader: r, tracker: t}
+}
+
+// WriterAt counts the bytes written to w.
+func (t *Tracker) WriterAt(w io.WriterAt) io.WriterAt {
+	return writerAt{w: w, tracker: t}
+}
+
+type writer struct {
+	w       io.WriteCloser
+	tracker *Tracker
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.tracker.Add(int64(n))
+	return n, err
+}
+
+func (w *writer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.w, countingReader{r: r, tracker: w.tracker})
+}
+
+func (w *writer) Close() error {
+	return w.w.Close()
+}
+
+type reader struct {
+	kv.Reader
+	tracker *Tracker
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.tracker.Add(int64(n))
+	return n, err
+}
+
+func (r *reader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(countingWriter{w: w, tracker: r.tracker}, r.Reader)
+}
+
+type countingReader struct {
+	r       io.Reader
+	tracker *Tracker
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.tracker.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w       io.Writer
+	tracker *Tracker
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.tracker.Add(int64(n))
+	return n, err
+}
+
+type writerAt struct {
+	w       io.WriterAt
+	tracker *Tracker
+}
+
+func (w writerAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.w.WriteAt(p, off)
+	w.tracker.Add(int64(n))
+	return n, err
+}
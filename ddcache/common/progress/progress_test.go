@@ -0,0 +1,107 @@
+package progress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+type recordingLogger struct {
+	log.Logger
+	lines []string
+}
+
+func (l *recordingLogger) Infof(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestTrackerReportsPerInterval(t *testing.T) {
+	logger := &recordingLogger{Logger: log.NewLogger()}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tracker := newTracker(logger, "Uploading", "main-archive", 100_000_000, 30*time.Second, clock.Now)
+
+	tracker.Add(10_000_000)
+	clock.now = clock.now.Add(10 * time.Second)
+	tracker.Add(10_000_000)
+	if len(logger.lines) != 0 {
+		t.Fatalf("logged %q before the interval passed", logger.lines)
+	}
+
+	clock.now = clock.now.Add(20 * time.Second)
+	tracker.Add(10_000_000)
+	clock.now = clock.now.Add(time.Second)
+	tracker.Add(10_000_000)
+	clock.now = clock.now.Add(9 * time.Second)
+	tracker.Done("Uploaded")
+
+	want := []string{
+		"Uploading main-archive: 30 MB of 100 MB (30%), 1.0 MB/s, ETA 1m10s",
+		"Uploaded main-archive - 40 MB in 40s (1.0 MB/s)",
+	}
+	if strings.Join(logger.lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("logged\n%s\nwant\n%s", strings.Join(logger.lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestTrackerSkippedAndRestarted(t *testing.T) {
+	logger := &recordingLogger{Logger: log.NewLogger()}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tracker := newTracker(logger, "Downloading", "archive", 0, time.Second, clock.Now)
+
+	tracker.Skip(5_000_000)
+	tracker.Add(3_000_000)
+	tracker.Restart(1_000_000)
+	tracker.Add(1_000_000)
+	clock.now = clock.now.Add(2 * time.Second)
+	tracker.Done("Downloaded")
+
+	want := "Downloaded archive - 2.0 MB in 2s (1.0 MB/s), 5.0 MB skipped"
+	if len(logger.lines) != 1 || logger.lines[0] != want {
+		t.Fatalf("logged %q, want %q", logger.lines, want)
+	}
+}
+
+func TestTrackerKeepsFastPaths(t *testing.T) {
+	tracker := newTracker(&recordingLogger{Logger: log.NewLogger()}, "Uploading", "key", 0, time.Hour, time.Now)
+	data := bytes.Repeat([]byte("x"), 100_000)
+
+	var dst readerFromBuffer
+	w := tracker.Writer(&dst)
+	// Hide bytes.Reader's WriterTo, like os.File does when it can't sendfile.
+	if _, err := io.Copy(w, struct{ io.Reader }{bytes.NewReader(data)}); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.readFrom || dst.Len() != len(data) {
+		t.Errorf("ReadFrom used: %t, got %d bytes", dst.readFrom, dst.Len())
+	}
+	if got := tracker.done.Load(); got != int64(len(data)) {
+		t.Errorf("counted %d bytes, want %d", got, len(data))
+	}
+}
+
+type readerFromBuffer struct {
+	bytes.Buffer
+	readFrom bool
+}
+
+func (b *readerFromBuffer) ReadFrom(r io.Reader) (int64, error) {
+	b.readFrom = true
+	return b.Buffer.ReadFrom(r)
+}
+
+func (b *readerFromBuffer) Close() error {
+	return nil
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+)
+
+const (
+	sha256Suffix = ".sha256"
+	lockSuffix   = ".lock"
+)
+
+// fileStorage stores every key as a file in a directory, e.g. on a volume
+// shared by the runners of a host. Next to each blob a "<key>.sha256"
+// sidecar holds its checksum.
+//
+// Blobs are written to a temporary file which is renamed into place once it
+// is complete and matches the expected checksum, so readers never see partial
+// blobs. Replacing a blob and its sidecar, and reading them, happens under an
+// advisory lock on "<key>.lock", so concurrent jobs get a matching pair.
+type fileStorage struct {
+	dir string
+}
+
+// NewFileStorage returns a Storage keeping blobs in dir, which is created if
+// it doesn't exist.
+func NewFileStorage(dir string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create %q: %w", dir, err)
+	}
+	return &fileStorage{dir: dir}, nil
+}
+
+func (s *fileStorage) path(name string) (string, error) {
+	if !filepath.IsLocal(name) || strings.HasSuffix(name, sha256Suffix) || strings.HasSuffix(name, lockSuffix) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid key %q", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *fileStorage) Put(_ context.Context, p kv.PutParams) (kv.Writer, error) {
+	if p.Offset != 0 {
+		return nil, status.Error(codes.InvalidArgument, "file storage can't resume uploads")
+	}
+	path, err := s.path(p.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, toStatus(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &fileWriter{
+		tmp:            tmp,
+		path:           path,
+		hash:           sha256.New(),
+		size:           p.FileSize,
+		expectedSha256: p.Sha256Sum,
+	}, nil
+}
+
+type fileWriter struct {
+	tmp            *os.File
+	path           string
+	hash           hash.Hash
+	written        int64
+	size           int64
+	expectedSha256 string
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.tmp.Write(p)
+	w.hash.Write(p[:n])
+	w.written += int64(n)
+	if err != nil {
+		return n, toStatus(err)
+	}
+	return n, nil
+}
+
+// Close stores the blob if it is complete and matches its checksum, and
+// discards it otherwise.
+func (w *fileWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+
+	if err := w.tmp.Sync(); err != nil {
+		w.tmp.Close()
+		return toStatus(err)
+	}
+	if err := w.tmp.Close(); err != nil {
+		return toStatus(err)
+	}
+	if w.written != w.size {
+		return status.Errorf(codes.InvalidArgument, "wrote %d of %d bytes", w.written, w.size)
+	}
+	sum := hex.EncodeToString(w.hash.Sum(nil))
+	if w.expectedSha256 != "" && sum != w.expectedSha256 {
+		return status.Errorf(codes.InvalidArgument, "sha256 mismatch: expected %s, got %s", w.expectedSha256, sum)
+	}
+
+	tmpSidecar := w.tmp.Name() + sha256Suffix
+	if err := os.WriteFile(tmpSidecar, []byte(sum+"\n"), 0o644); err != nil {
+		return toStatus(err)
+	}
+	defer os.Remove(tmpSidecar)
+
+	unlock, err := lockFile(w.path+lockSuffix, true)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer unlock()
+
+	// Without a sidecar a reader can't verify the blob, which is better than
+	// verifying the new blob against the old checksum if renaming is cut short.
+	if err := os.Remove(w.path + sha256Suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return toStatus(err)
+	}
+	if err := os.Rename(w.tmp.Name(), w.path); err != nil {
+		return toStatus(err)
+	}
+	if err := os.Rename(tmpSidecar, w.path+sha256Suffix); err != nil {
+		return toStatus(err)
+	}
+	return nil
+}
+
+// Abort removes the temporary file.
+func (w *fileWriter) Abort() error {
+	w.tmp.Close()
+	if err := os.Remove(w.tmp.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return toStatus(err)
+	}
+	return nil
+}
+
+// open opens the blob and reads its checksum, under a shared lock.
+func (s *fileStorage) open(name string) (*os.File, string, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		// Don't create lock files for keys which were never stored.
+		return nil, "", toStatus(err)
+	}
+
+	unlock, err := lockFile(path+lockSuffix, false)
+	if err != nil {
+		return nil, "", toStatus(err)
+	}
+	defer unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", toStatus(err)
+	}
+	sum, err := os.ReadFile(path + sha256Suffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		file.Close()
+		return nil, "", toStatus(err)
+	}
+	return file, strings.TrimSpace(string(sum)), nil
+}
+
+func (s *fileStorage) Get(_ context.Context, p kv.GetParams) (kv.Reader, error) {
+	file, sum, err := s.open(p.Name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(p.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, toStatus(err)
+	}
+
+	var r io.Reader = file
+	if p.Limit > 0 {
+		r = io.LimitReader(file, p.Limit)
+	}
+	return &fileReader{Reader: r, file: file, sha256: sum}, nil
+}
+
+type fileReader struct {
+	io.Reader
+	file   *os.File
+	sha256 string
+}
+
+func (r *fileReader) Close() error {
+	return r.file.Close()
+}
+
+func (r *fileReader) Sha256Sum() string {
+	return r.sha256
+}
+
+func (s *fileStorage) Stat(_ context.Context, name string) (kv.StatResult, error) {
+	file, sum, err := s.open(name)
+	if status.Code(err) == codes.NotFound {
+		return kv.StatResult{}, nil
+	}
+	if err != nil {
+		return kv.StatResult{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return kv.StatResult{}, toStatus(err)
+	}
+	return kv.StatResult{
+		Exists:    true,
+		Size:      info.Size(),
+		Sha256Sum: sum,
+	}, nil
+}
+
+func (s *fileStorage) Delete(_ context.Context, name string) (bool, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	unlock, err := lockFile(path+lockSuffix, true)
+	if err != nil {
+		return false, toStatus(err)
+	}
+	defer unlock()
+
+	if err := os.Remove(path + sha256Suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, toStatus(err)
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, toStatus(err)
+	}
+	return true, nil
+}
+
+func (s *fileStorage) Close() error {
+	return nil
+}
+
+// toStatus maps file system errors to gRPC status errors.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, fs.ErrPermission):
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -0,0 +1,159 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+)
+
+func newFileStorage(t *testing.T) (storage.Storage, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	store, err := storage.New(context.Background(), "file://"+filepath.ToSlash(dir), kv.NewClientParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, dir
+}
+
+func TestFileStorageRoundTrip(t *testing.T) {
+	store, _ := newFileStorage(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(100 * 1024)
+
+	if err := kvtest.Put(ctx, store, "feature/x-archive", data); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	stat, err := store.Stat(ctx, "feature/x-archive")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	if !stat.Exists || stat.Size != int64(len(data)) || stat.Sha256Sum != kvtest.Sha256Hex(data) {
+		t.Errorf("got stat %+v", stat)
+	}
+
+	r, err := store.Get(ctx, kv.GetParams{Name: "feature/x-archive", Offset: 10, Limit: 1000})
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !bytes.Equal(got, data[10:1010]) {
+		t.Errorf("got %d bytes, want bytes 10-1010", len(got))
+	}
+	if r.Sha256Sum() != kvtest.Sha256Hex(data) {
+		t.Errorf("got sha256 %s, want %s", r.Sha256Sum(), kvtest.Sha256Hex(data))
+	}
+
+	if deleted, err := store.Delete(ctx, "feature/x-archive"); err != nil || !deleted {
+		t.Fatalf("delete: %t, %v", deleted, err)
+	}
+	if _, err := store.Get(ctx, kv.GetParams{Name: "feature/x-archive"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("get after delete: %v, want NotFound", err)
+	}
+}
+
+func TestFileStorageDiscardsMismatchingUpload(t *testing.T) {
+	store, dir := newFileStorage(t)
+	ctx := context.Background()
+	previous := kvtest.RandomData(1024)
+	if err := kvtest.Put(ctx, store, "main-archive", previous); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	data := kvtest.RandomData(1000)
+	p := kv.PutParams{Name: "main-archive", Sha256Sum: kvtest.Sha256Hex(previous), FileSize: int64(len(data))}
+	if err := kvtest.PutRange(ctx, store, p, data, int64(len(data))); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("put with wrong checksum: %v, want InvalidArgument", err)
+	}
+
+	stat, err := store.Stat(ctx, "main-archive")
+	if err != nil || stat.Sha256Sum != kvtest.Sha256Hex(previous) {
+		t.Fatalf("previous blob was replaced: %+v, %v", stat, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == ".tmp" {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestFileStorageAbort(t *testing.T) {
+	store, dir := newFileStorage(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(1024)
+
+	w, err := store.Put(ctx, kv.PutParams{Name: "main-archive", Sha256Sum: kvtest.Sha256Hex(data), FileSize: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:512]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("abort: %s", err)
+	}
+
+	if stat, err := store.Stat(ctx, "main-archive"); err != nil || stat.Exists {
+		t.Fatalf("aborted upload was stored: %+v, %v", stat, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%s left behind", entries[0].Name())
+	}
+}
+
+func TestFileStorageConcurrentPuts(t *testing.T) {
+	store, _ := newFileStorage(t)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := kvtest.RandomData(256*1024 + i)
+			if err := kvtest.Put(ctx, store, "main-archive", data); err != nil {
+				t.Errorf("put: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r, err := store.Get(ctx, kv.GetParams{Name: "main-archive"})
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if kvtest.Sha256Hex(got) != r.Sha256Sum() {
+		t.Fatal("blob doesn't match its sidecar")
+	}
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+)
+
+// Sha256Header carries the sha256 checksum of a blob, hex encoded: sent with
+// uploads for the server to validate, and read from download responses to
+// verify the blob with.
+const Sha256Header = "X-Checksum-Sha256"
+
+// httpStorage stores every key as an object under a base URL, using plain
+// PUT, GET, HEAD and DELETE requests, e.g. against nginx with WebDAV enabled
+// or any other generic HTTP object cache.
+type httpStorage struct {
+	baseURL *url.URL
+	client  *http.Client
+	tokens  kv.TokenSource
+}
+
+// NewHTTPStorage returns a Storage keeping blobs under baseURL. The token and
+// TLS options of params are used, the connection related ones are ignored.
+func NewHTTPStorage(baseURL string, params kv.NewClientParams) (Storage, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("the url http[s]://host[:port][/path] format, %q is invalid", baseURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if parsed.Scheme == "https" {
+		tlsConfig, err := kv.NewTLSConfig(params)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	} else if params.CACertPath != "" || params.ClientCertPath != "" || params.ClientKeyPath != "" || params.ServerName != "" {
+		return nil, errors.New("TLS options require an https:// service URL")
+	}
+
+	tokens := params.TokenSource
+	if tokens == nil {
+		tokens = kv.StaticToken(params.Token)
+	}
+
+	return &httpStorage{
+		baseURL: parsed,
+		client:  &http.Client{Transport: transport},
+		tokens:  tokens,
+	}, nil
+}
+
+func (s *httpStorage) newRequest(ctx context.Context, method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.baseURL.JoinPath(name).String(), body)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "new request: %s", err)
+	}
+	token, err := s.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// do sends req, and turns failures to send it or error responses into status
+// errors.
+func (s *httpStorage) do(req *http.Request) (*http.Response, error) {
+	resp, err := doHTTP(s.client, req)
+	if err != nil {
+		return nil, kv.CheckTokenRejected(s.tokens, err)
+	}
+	return resp, nil
+}
+
+// doHTTP sends req, and turns failures to send it or error responses into
+// status errors. A 416 response is returned as is, see newRangeReader.
+func doHTTP(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, status.FromContextError(ctxErr).Err()
+		}
+		return nil, status.Errorf(codes.Unavailable, "%s %s: %s", req.Method, req.URL.Redacted(), err)
+	}
+	if resp.StatusCode < 300 || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, status.Errorf(httpStatusCode(resp.StatusCode), "%s %s: %s: %s",
+		req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(message)))
+}
+
+// httpStatusCode maps an HTTP error status to the status code with the same
+// meaning for kv.IsRetryable.
+func httpStatusCode(statusCode int) codes.Code {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusLengthRequired, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound, http.StatusGone:
+		return codes.NotFound
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return codes.Aborted
+	case http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	if statusCode >= 500 {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+func (s *httpStorage) Put(ctx context.Context, p kv.PutParams) (kv.Writer, error) {
+	if p.Offset != 0 {
+		return nil, status.Error(codes.InvalidArgument, "http storage can't resume uploads")
+	}
+
+	pr, pw := io.Pipe()
+	var body io.Reader = pr
+	if p.FileSize == 0 {
+		body = http.NoBody
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, p.Name, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = p.FileSize
+	if p.Sha256Sum != "" {
+		req.Header.Set(Sha256Header, p.Sha256Sum)
+	}
+
+	w := &httpWriter{
+		pipe: pw,
+		size: p.FileSize,
+		done: make(chan error, 1),
+	}
+	go func() {
+		resp, err := s.do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		// Unblock Write if the request ended before the body was sent.
+		pr.CloseWithError(io.ErrClosedPipe)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+type httpWriter struct {
+	pipe    *io.PipeWriter
+	written int64
+	size    int64
+	done    chan error
+	err     error
+}
+
+func (w *httpWriter) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	w.written += int64(n)
+	if err != nil {
+		// The request ended early, its outcome tells why.
+		if respErr := w.wait(); respErr != nil {
+			return n, respErr
+		}
+		return n, status.Error(codes.Internal, "server closed the request before the upload finished")
+	}
+	return n, nil
+}
+
+// Close finishes the upload and returns the outcome of the request.
+func (w *httpWriter) Close() error {
+	if w.written != w.size {
+		w.pipe.CloseWithError(io.ErrUnexpectedEOF)
+		_ = w.wait()
+		return status.Errorf(codes.InvalidArgument, "wrote %d of %d bytes", w.written, w.size)
+	}
+	w.pipe.Close()
+	return w.wait()
+}
+
+// errAborted fails the body of aborted uploads.
+var errAborted = errors.New("upload aborted")
+
+// Abort fails the request body, so that the request ends without storing
+// the blob, and waits for it.
+func (w *httpWriter) Abort() error {
+	w.pipe.CloseWithError(errAborted)
+	_ = w.wait()
+	return nil
+}
+
+func (w *httpWriter) wait() error {
+	if w.done != nil {
+		w.err = <-w.done
+		w.done = nil
+	}
+	return w.err
+}
+
+func (s *httpStorage) Get(ctx context.Context, p kv.GetParams) (kv.Reader, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, p.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRange(req, p)
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return newRangeReader(resp, p, resp.Header.Get(Sha256Header))
+}
+
+func setRange(req *http.Request, p kv.GetParams) {
+	if p.Limit > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", p.Offset, p.Offset+p.Limit-1))
+	} else if p.Offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", p.Offset))
+	}
+}
+
+// newRangeReader reads the range of p from the response to a request made
+// with setRange.
+func newRangeReader(resp *http.Response, p kv.GetParams, sha256 string) (kv.Reader, error) {
+	r := &httpReader{
+		Reader: resp.Body,
+		body:   resp.Body,
+		sha256: sha256,
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		var size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err != nil || p.Offset != size {
+			// The offset is past the end, e.g. a partial download of a larger
+			// blob which was replaced since: the caller has to start over.
+			resp.Body.Close()
+			return nil, status.Errorf(codes.OutOfRange, "offset %d is past the end of the blob (%q)", p.Offset, resp.Header.Get("Content-Range"))
+		}
+		// The offset is the end of the blob, e.g. when resuming a download
+		// which was already complete.
+		r.Reader = strings.NewReader("")
+	case http.StatusPartialContent:
+	default:
+		// The server ignored the range, skip to it.
+		if _, err := io.CopyN(io.Discard, resp.Body, p.Offset); err != nil {
+			resp.Body.Close()
+			return nil, status.Errorf(codes.Unavailable, "skip to offset %d: %s", p.Offset, err)
+		}
+		if p.Limit > 0 {
+			r.Reader = io.LimitReader(resp.Body, p.Limit)
+		}
+	}
+	return r, nil
+}
+
+type httpReader struct {
+	io.Reader
+	body   io.Closer
+	sha256 string
+}
+
+func (r *httpReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		// A broken connection mid-body is as transient as failing to connect.
+		return n, status.Errorf(codes.Unavailable, "read body: %s", err)
+	}
+	return n, err
+}
+
+func (r *httpReader) Close() error {
+	return r.body.Close()
+}
+
+func (r *httpReader) Sha256Sum() string {
+	return r.sha256
+}
+
+func (s *httpStorage) Stat(ctx context.Context, name string) (kv.StatResult, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		return kv.StatResult{}, err
+	}
+	resp, err := s.do(req)
+	if status.Code(err) == codes.NotFound {
+		return kv.StatResult{}, nil
+	}
+	if err != nil {
+		return kv.StatResult{}, err
+	}
+	resp.Body.Close()
+
+	return kv.StatResult{
+		Exists: true,
+		// Unknown (-1) if the server doesn't send Content-Length.
+		Size:      resp.ContentLength,
+		Sha256Sum: resp.Header.Get(Sha256Header),
+	}, nil
+}
+
+func (s *httpStorage) Delete(ctx context.Context, name string) (bool, error) {
+	req, err := s.newRequest(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do(req)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *httpStorage) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
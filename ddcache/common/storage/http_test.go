@@ -0,0 +1,238 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+)
+
+// objectServer is a minimal HTTP object cache, serving ranges with
+// http.ServeContent like common web servers do.
+type objectServer struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	failNext  int
+	requests  int
+	lastRange string
+	url       string
+}
+
+func (s *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+	if s.failNext > 0 {
+		s.failNext--
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/cache/")
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(data)) != r.ContentLength || kvtest.Sha256Hex(data) != r.Header.Get(storage.Sha256Header) {
+			http.Error(w, "content mismatch", http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = data
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.lastRange = r.Header.Get("Range")
+		w.Header().Set(storage.Sha256Header, kvtest.Sha256Hex(data))
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+	case http.MethodDelete:
+		if _, ok := s.objects[key]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newHTTPStorage(t *testing.T) (storage.Storage, *objectServer) {
+	t.Helper()
+
+	server := &objectServer{objects: map[string][]byte{}}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	server.url = httpServer.URL + "/cache"
+
+	store, err := storage.New(context.Background(), server.url, kv.NewClientParams{Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, server
+}
+
+func TestHTTPStorageRoundTrip(t *testing.T) {
+	store, server := newHTTPStorage(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(100 * 1024)
+
+	if err := kvtest.Put(ctx, store, "feature/x-archive", data); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	stat, err := store.Stat(ctx, "feature/x-archive")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	if !stat.Exists || stat.Size != int64(len(data)) || stat.Sha256Sum != kvtest.Sha256Hex(data) {
+		t.Errorf("got stat %+v", stat)
+	}
+
+	r, err := store.Get(ctx, kv.GetParams{Name: "feature/x-archive", Offset: 10, Limit: 1000})
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !bytes.Equal(got, data[10:1010]) {
+		t.Errorf("got %d bytes, want bytes 10-1010", len(got))
+	}
+	if server.lastRange != "bytes=10-1009" {
+		t.Errorf("requested range %q", server.lastRange)
+	}
+
+	if deleted, err := store.Delete(ctx, "feature/x-archive"); err != nil || !deleted {
+		t.Fatalf("delete: %t, %v", deleted, err)
+	}
+	if stat, err := store.Stat(ctx, "feature/x-archive"); err != nil || stat.Exists {
+		t.Fatalf("stat after delete: %+v, %v", stat, err)
+	}
+	if _, err := store.Get(ctx, kv.GetParams{Name: "feature/x-archive"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("get after delete: %v, want NotFound", err)
+	}
+}
+
+func TestHTTPStorageAbort(t *testing.T) {
+	store, server := newHTTPStorage(t)
+	data := kvtest.RandomData(100 * 1024)
+
+	w, err := store.Put(context.Background(), kv.PutParams{
+		Name:      "main-archive",
+		Sha256Sum: kvtest.Sha256Hex(data),
+		FileSize:  int64(len(data)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:1024]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("abort: %s", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, ok := server.objects["main-archive"]; ok {
+		t.Error("aborted upload was stored")
+	}
+}
+
+func TestHTTPStorageStatOfUnknownSize(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(httpServer.Close)
+	store, err := storage.New(context.Background(), httpServer.URL, kv.NewClientParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := store.Stat(context.Background(), "main-archive")
+	if err != nil || !stat.Exists || stat.Size != -1 {
+		t.Fatalf("got stat %+v, %v, want an entry of unknown size", stat, err)
+	}
+}
+
+func TestHTTPStorageResumeAtEnd(t *testing.T) {
+	store, _ := newHTTPStorage(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(1024)
+	if err := kvtest.Put(ctx, store, "main-archive", data); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	r, err := store.Get(ctx, kv.GetParams{Name: "main-archive", Offset: int64(len(data))})
+	if err != nil {
+		t.Fatalf("get from the end: %s", err)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || len(got) != 0 {
+		t.Fatalf("read from the end: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestHTTPStorageResumePastEnd(t *testing.T) {
+	store, _ := newHTTPStorage(t)
+	ctx := context.Background()
+	if err := kvtest.Put(ctx, store, "main-archive", kvtest.RandomData(1024)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	_, err := store.Get(ctx, kv.GetParams{Name: "main-archive", Offset: 2048})
+	if status.Code(err) != codes.OutOfRange {
+		t.Fatalf("get past the end: %v, want OutOfRange", err)
+	}
+}
+
+func TestHTTPStorageErrorsFollowRetryPolicy(t *testing.T) {
+	store, server := newHTTPStorage(t)
+	ctx := context.Background()
+	data := kvtest.RandomData(1024)
+	retryPolicy := kv.RetryPolicy{MaxAttempts: 3, BaseWait: time.Millisecond, MaxWait: 10 * time.Millisecond}
+
+	server.failNext = 2
+	err := retryPolicy.Do(ctx, func(int) error {
+		return kvtest.Put(ctx, store, "main-archive", data)
+	})
+	if err != nil {
+		t.Fatalf("put with retries: %s", err)
+	}
+	if server.requests != 3 {
+		t.Errorf("made %d requests, want 3", server.requests)
+	}
+
+	unauthenticated, err := storage.New(ctx, server.url, kv.NewClientParams{Token: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unauthenticated.Close()
+	_, err = unauthenticated.Stat(ctx, "main-archive")
+	if status.Code(err) != codes.Unauthenticated || kv.IsRetryable(err) {
+		t.Fatalf("stat with wrong token: %v, want a non-retryable Unauthenticated", err)
+	}
+}
@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+)
+
+// reapiStorage stores blobs on a Remote Execution API cache, e.g.
+// bazel-remote or BuildBuddy. The content goes into the CAS, and each key is
+// mapped to the digest of its current content by an ActionCache entry, whose
+// action digest is derived from the key. The entry has a single output file,
+// named after the key.
+//
+// REAPI has no deletion: Delete replaces the entry with one without outputs,
+// which is reported as missing, and leaves the content to the cache's
+// eviction.
+type reapiStorage struct {
+	conn         *grpc.ClientConn
+	cas          repb.ContentAddressableStorageClient
+	actionCache  repb.ActionCacheClient
+	bytestream   bytestream.ByteStreamClient
+	instanceName string
+	tokens       kv.TokenSource
+}
+
+// NewREAPIStorage connects to the REAPI cache at params.Host. Resource names
+// are prefixed with instanceName, if not empty.
+func NewREAPIStorage(ctx context.Context, instanceName string, params kv.NewClientParams) (Storage, error) {
+	conn, err := kv.Dial(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := params.TokenSource
+	if tokens == nil {
+		tokens = kv.StaticToken(params.Token)
+	}
+
+	return &reapiStorage{
+		conn:         conn,
+		cas:          repb.NewContentAddressableStorageClient(conn),
+		actionCache:  repb.NewActionCacheClient(conn),
+		bytestream:   bytestream.NewByteStreamClient(conn),
+		instanceName: instanceName,
+		tokens:       tokens,
+	}, nil
+}
+
+// parseREAPIURL splits reapi[s]://host:port[/instance] into the host, whether
+// the connection is insecure and the instance name.
+func parseREAPIURL(s string) (string, bool, string, error) {
+	parsed, err := url.Parse(s)
+	if err != nil {
+		return "", false, "", fmt.Errorf("parse url: %w", err)
+	}
+	if parsed.Port() == "" {
+		return "", false, "", fmt.Errorf("the url reapi[s]://host:port[/instance] format, %q is invalid: must provide a port", s)
+	}
+	return parsed.Host, parsed.Scheme == "reapi", strings.Trim(parsed.Path, "/"), nil
+}
+
+func (s *reapiStorage) authorize(ctx context.Context) (context.Context, error) {
+	token, err := s.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return ctx, nil
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token), nil
+}
+
+func (s *reapiStorage) resourceName(parts ...string) string {
+	if s.instanceName != "" {
+		parts = append([]string{s.instanceName}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// actionDigest is the ActionCache key of name. It isn't the digest of an
+// actual Action, so it never collides with the entries of builds.
+func actionDigest(name string) *repb.Digest {
+	data := []byte("ddcache/" + name)
+	sum := sha256.Sum256(data)
+	return &repb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+}
+
+// lookup returns the digest of the content stored under name.
+func (s *reapiStorage) lookup(ctx context.Context, name string) (*repb.Digest, error) {
+	ctx, err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.actionCache.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName:   s.instanceName,
+		ActionDigest:   actionDigest(name),
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	if err != nil {
+		return nil, kv.CheckTokenRejected(s.tokens, err)
+	}
+	for _, file := range result.GetOutputFiles() {
+		if file.GetPath() == name && file.GetDigest() != nil {
+			return file.GetDigest(), nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "%s was deleted", name)
+}
+
+// bind points the ActionCache entry of name at digest, or marks it deleted
+// if digest is nil.
+func (s *reapiStorage) bind(ctx context.Context, name string, digest *repb.Digest) error {
+	ctx, err := s.authorize(ctx)
+	if err != nil {
+		return err
+	}
+	result := &repb.ActionResult{}
+	if digest != nil {
+		result.OutputFiles = []*repb.OutputFile{{Path: name, Digest: digest}}
+	}
+	_, err = s.actionCache.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName:   s.instanceName,
+		ActionDigest:   actionDigest(name),
+		ActionResult:   result,
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	if err != nil {
+		return kv.CheckTokenRejected(s.tokens, err)
+	}
+	return nil
+}
+
+func (s *reapiStorage) Put(ctx context.Context, p kv.PutParams) (kv.Writer, error) {
+	if p.Offset != 0 {
+		return nil, status.Error(codes.InvalidArgument, "REAPI storage can't resume uploads")
+	}
+	if p.Sha256Sum == "" {
+		return nil, status.Error(codes.InvalidArgument, "REAPI storage needs the sha256 of blobs upfront")
+	}
+	digest := &repb.Digest{Hash: p.Sha256Sum, SizeBytes: p.FileSize}
+	w := &reapiWriter{
+		ctx:     ctx,
+		storage: s,
+		name:    p.Name,
+		digest:  digest,
+	}
+
+	authCtx, err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	missing, err := s.cas.FindMissingBlobs(authCtx, &repb.FindMissingBlobsRequest{
+		InstanceName:   s.instanceName,
+		BlobDigests:    []*repb.Digest{digest},
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	if err != nil {
+		return nil, kv.CheckTokenRejected(s.tokens, err)
+	}
+	if len(missing.GetMissingBlobDigests()) == 0 {
+		// Another key or an earlier build already stored the content.
+		return w, nil
+	}
+
+	uuid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	streamCtx, cancel := context.WithCancel(authCtx)
+	w.stream, err = s.bytestream.Write(streamCtx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("initiate write: %w", kv.CheckTokenRejected(s.tokens, err))
+	}
+	w.cancel = cancel
+	w.resourceName = s.resourceName("uploads", uuid, "blobs", digest.Hash, fmt.Sprint(digest.SizeBytes))
+	return w, nil
+}
+
+// reapiWriter writes the content into the CAS, unless it is already there,
+// and binds it to the key on Close.
+type reapiWriter struct {
+	ctx          context.Context
+	storage      *reapiStorage
+	name         string
+	digest       *repb.Digest
+	stream       bytestream.ByteStream_WriteClient
+	cancel       context.CancelFunc
+	resourceName string
+	offset       int64
+	finished     bool
+}
+
+func (w *reapiWriter) Write(p []byte) (int, error) {
+	if w.stream == nil || w.finished {
+		return len(p), nil
+	}
+
+	req := &bytestream.WriteRequest{
+		WriteOffset: w.offset,
+		Data:        p,
+		FinishWrite: w.offset+int64(len(p)) >= w.digest.SizeBytes,
+	}
+	// The resource name is only required on the first request.
+	if w.offset == 0 {
+		req.ResourceName = w.resourceName
+	}
+	w.finished = req.FinishWrite
+	err := w.stream.Send(req)
+	switch {
+	case errors.Is(err, io.EOF):
+		// The CAS ended the write early: it failed, or the blob got committed
+		// concurrently. Its actual status is returned by CloseAndRecv.
+		if _, recvErr := w.stream.CloseAndRecv(); recvErr != nil {
+			return 0, fmt.Errorf("send data: %w", kv.CheckTokenRejected(w.storage.tokens, recvErr))
+		}
+		w.stream = nil
+		return len(p), nil
+	case err != nil:
+		return 0, fmt.Errorf("send data: %w", err)
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (w *reapiWriter) Close() error {
+	if w.stream != nil {
+		defer w.cancel()
+		if !w.finished {
+			if w.offset != w.digest.SizeBytes {
+				_ = w.stream.CloseSend()
+				return status.Errorf(codes.InvalidArgument, "wrote %d of %d bytes", w.offset, w.digest.SizeBytes)
+			}
+			// Nothing was written (empty blob), but the CAS still expects a
+			// finishing request.
+			req := &bytestream.WriteRequest{ResourceName: w.resourceName, FinishWrite: true}
+			if err := w.stream.Send(req); err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("send finish: %w", err)
+			}
+		}
+		if _, err := w.stream.CloseAndRecv(); err != nil {
+			return fmt.Errorf("close stream: %w", kv.CheckTokenRejected(w.storage.tokens, err))
+		}
+	}
+
+	if err := w.storage.bind(w.ctx, w.name, w.digest); err != nil {
+		return fmt.Errorf("update action result: %w", err)
+	}
+	return nil
+}
+
+// Abort cancels the write stream, if any, and doesn't bind the key.
+func (w *reapiWriter) Abort() error {
+	if w.stream != nil {
+		w.cancel()
+		w.stream = nil
+	}
+	return nil
+}
+
+func (s *reapiStorage) Get(ctx context.Context, p kv.GetParams) (kv.Reader, error) {
+	digest, err := s.lookup(ctx, p.Name)
+	if err != nil {
+		return nil, err
+	}
+	if p.Offset >= digest.SizeBytes {
+		// ByteStream rejects reading from the end, e.g. to resume a complete download.
+		return &reapiReader{sha256: digest.Hash}, nil
+	}
+
+	ctx, err = s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := s.bytestream.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: s.resourceName("blobs", digest.Hash, fmt.Sprint(digest.SizeBytes)),
+		ReadOffset:   p.Offset,
+		ReadLimit:    p.Limit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initiate read: %w", kv.CheckTokenRejected(s.tokens, err))
+	}
+	return &reapiReader{stream: stream, sha256: digest.Hash, tokens: s.tokens}, nil
+}
+
+type reapiReader struct {
+	stream bytestream.ByteStream_ReadClient
+	buf    bytes.Buffer
+	sha256 string
+	tokens kv.TokenSource
+}
+
+func (r *reapiReader) Read(p []byte) (int, error) {
+	if r.stream == nil {
+		return 0, io.EOF
+	}
+	for r.buf.Len() == 0 {
+		resp, err := r.stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.EOF
+			}
+			return 0, fmt.Errorf("stream receive: %w", kv.CheckTokenRejected(r.tokens, err))
+		}
+		r.buf.Write(resp.GetData())
+	}
+	return r.buf.Read(p)
+}
+
+func (r *reapiReader) Close() error {
+	if r.stream == nil {
+		return nil
+	}
+	return r.stream.CloseSend()
+}
+
+// Sha256Sum is the CAS digest of the blob.
+func (r *reapiReader) Sha256Sum() string {
+	return r.sha256
+}
+
+func (s *reapiStorage) Stat(ctx context.Context, name string) (kv.StatResult, error) {
+	digest, err := s.lookup(ctx, name)
+	if status.Code(err) == codes.NotFound {
+		return kv.StatResult{}, nil
+	}
+	if err != nil {
+		return kv.StatResult{}, fmt.Errorf("stat: %w", err)
+	}
+	return kv.StatResult{
+		Exists:    true,
+		Size:      digest.SizeBytes,
+		Sha256Sum: digest.Hash,
+	}, nil
+}
+
+func (s *reapiStorage) Delete(ctx context.Context, name string) (bool, error) {
+	_, err := s.lookup(ctx, name)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("delete: %w", err)
+	}
+	if err := s.bind(ctx, name, nil); err != nil {
+		return false, fmt.Errorf("delete: %w", err)
+	}
+	return true, nil
+}
+
+func (s *reapiStorage) Close() error {
+	return s.conn.Close()
+}
+
+// newUUID returns a random (version 4) UUID, as upload resource names want.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generate upload id: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
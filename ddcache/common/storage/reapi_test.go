@@ -0,0 +1,291 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+)
+
+// reapiServer is an in-memory REAPI cache serving the CAS, the ActionCache
+// and ByteStream for the "main" instance.
+type reapiServer struct {
+	repb.UnimplementedContentAddressableStorageServer
+	repb.UnimplementedActionCacheServer
+	bytestream.UnimplementedByteStreamServer
+
+	mu             sync.Mutex
+	blobs          map[string][]byte
+	actionResults  map[string]*repb.ActionResult
+	writes         int
+	writeResources []string
+}
+
+func (s *reapiServer) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) == 0 || values[0] != "Bearer token" {
+		return status.Error(codes.Unauthenticated, "bad token")
+	}
+	return nil
+}
+
+func (s *reapiServer) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &repb.FindMissingBlobsResponse{}
+	for _, digest := range req.GetBlobDigests() {
+		if _, ok := s.blobs[digest.GetHash()]; !ok {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, digest)
+		}
+	}
+	return resp, nil
+}
+
+func (s *reapiServer) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.actionResults[req.GetInstanceName()+"/"+req.GetActionDigest().GetHash()]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no action result")
+	}
+	return result, nil
+}
+
+func (s *reapiServer) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, file := range req.GetActionResult().GetOutputFiles() {
+		if _, ok := s.blobs[file.GetDigest().GetHash()]; !ok {
+			return nil, status.Error(codes.FailedPrecondition, "output is missing from the CAS")
+		}
+	}
+	s.actionResults[req.GetInstanceName()+"/"+req.GetActionDigest().GetHash()] = proto.Clone(req.GetActionResult()).(*repb.ActionResult)
+	return req.GetActionResult(), nil
+}
+
+func (s *reapiServer) Write(stream bytestream.ByteStream_WriteServer) error {
+	if err := s.authorize(stream.Context()); err != nil {
+		return err
+	}
+
+	var resourceName string
+	var data []byte
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if req.GetResourceName() != "" {
+			resourceName = req.GetResourceName()
+		}
+		if req.GetWriteOffset() != int64(len(data)) {
+			return status.Error(codes.InvalidArgument, "unexpected write offset")
+		}
+		data = append(data, req.GetData()...)
+		if req.GetFinishWrite() {
+			break
+		}
+	}
+
+	// main/uploads/<uuid>/blobs/<hash>/<size>
+	parts := strings.Split(resourceName, "/")
+	if len(parts) != 6 || parts[0] != "main" || parts[1] != "uploads" || parts[3] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "invalid resource name %q", resourceName)
+	}
+	if kvtest.Sha256Hex(data) != parts[4] || strconv.Itoa(len(data)) != parts[5] {
+		return status.Error(codes.InvalidArgument, "digest mismatch")
+	}
+
+	s.mu.Lock()
+	s.blobs[parts[4]] = data
+	s.writes++
+	s.writeResources = append(s.writeResources, resourceName)
+	s.mu.Unlock()
+	return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(len(data))})
+}
+
+func (s *reapiServer) Read(req *bytestream.ReadRequest, stream bytestream.ByteStream_ReadServer) error {
+	if err := s.authorize(stream.Context()); err != nil {
+		return err
+	}
+
+	// main/blobs/<hash>/<size>
+	parts := strings.Split(req.GetResourceName(), "/")
+	if len(parts) != 4 || parts[0] != "main" || parts[1] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "invalid resource name %q", req.GetResourceName())
+	}
+	s.mu.Lock()
+	data, ok := s.blobs[parts[2]]
+	s.mu.Unlock()
+	if !ok {
+		return status.Error(codes.NotFound, "blob not found")
+	}
+	if req.GetReadOffset() >= int64(len(data)) {
+		return status.Error(codes.OutOfRange, "read offset out of range")
+	}
+	data = data[req.GetReadOffset():]
+	if req.GetReadLimit() > 0 && req.GetReadLimit() < int64(len(data)) {
+		data = data[:req.GetReadLimit()]
+	}
+	for len(data) > 0 {
+		n := min(len(data), 64*1024)
+		if err := stream.Send(&bytestream.ReadResponse{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func newREAPIStorage(t *testing.T, token string) (storage.Storage, *reapiServer) {
+	t.Helper()
+
+	server := &reapiServer{
+		blobs:         map[string][]byte{},
+		actionResults: map[string]*repb.ActionResult{},
+	}
+	grpcServer := grpc.NewServer()
+	repb.RegisterContentAddressableStorageServer(grpcServer, server)
+	repb.RegisterActionCacheServer(grpcServer, server)
+	bytestream.RegisterByteStreamServer(grpcServer, server)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = grpcServer.Serve(listener) }()
+	t.Cleanup(grpcServer.Stop)
+
+	store, err := storage.New(context.Background(), "reapi://"+listener.Addr().String()+"/main", kv.NewClientParams{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, server
+}
+
+func TestREAPIStorageRoundTrip(t *testing.T) {
+	store, server := newREAPIStorage(t, "token")
+	ctx := context.Background()
+	data := kvtest.RandomData(300 * 1024)
+
+	if err := kvtest.Put(ctx, store, "feature/x-archive", data); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if len(server.writeResources) != 1 || !strings.HasPrefix(server.writeResources[0], "main/uploads/") {
+		t.Errorf("wrote %q", server.writeResources)
+	}
+
+	stat, err := store.Stat(ctx, "feature/x-archive")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	if !stat.Exists || stat.Size != int64(len(data)) || stat.Sha256Sum != kvtest.Sha256Hex(data) {
+		t.Errorf("got stat %+v", stat)
+	}
+
+	r, err := store.Get(ctx, kv.GetParams{Name: "feature/x-archive", Offset: 100, Limit: 100 * 1024})
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !bytes.Equal(got, data[100:100+100*1024]) {
+		t.Errorf("got %d bytes, want bytes 100-%d", len(got), 100+100*1024)
+	}
+	if r.Sha256Sum() != kvtest.Sha256Hex(data) {
+		t.Errorf("got checksum %q", r.Sha256Sum())
+	}
+
+	r, err = store.Get(ctx, kv.GetParams{Name: "feature/x-archive", Offset: int64(len(data))})
+	if err != nil {
+		t.Fatalf("get from the end: %s", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || len(got) != 0 {
+		t.Fatalf("read from the end: %d bytes, %v", len(got), err)
+	}
+
+	if deleted, err := store.Delete(ctx, "feature/x-archive"); err != nil || !deleted {
+		t.Fatalf("delete: %t, %v", deleted, err)
+	}
+	if deleted, err := store.Delete(ctx, "feature/x-archive"); err != nil || deleted {
+		t.Fatalf("second delete: %t, %v", deleted, err)
+	}
+	if stat, err := store.Stat(ctx, "feature/x-archive"); err != nil || stat.Exists {
+		t.Fatalf("stat after delete: %+v, %v", stat, err)
+	}
+	if _, err := store.Get(ctx, kv.GetParams{Name: "feature/x-archive"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("get after delete: %v, want NotFound", err)
+	}
+}
+
+func TestREAPIStorageSkipsStoredContent(t *testing.T) {
+	store, server := newREAPIStorage(t, "token")
+	ctx := context.Background()
+	data := kvtest.RandomData(1024)
+
+	for _, name := range []string{"main-archive", "feature/x-archive"} {
+		if err := kvtest.Put(ctx, store, name, data); err != nil {
+			t.Fatalf("put %s: %s", name, err)
+		}
+	}
+	if server.writes != 1 {
+		t.Errorf("uploaded the content %d times, want once", server.writes)
+	}
+	for _, name := range []string{"main-archive", "feature/x-archive"} {
+		if stat, err := store.Stat(ctx, name); err != nil || !stat.Exists {
+			t.Errorf("stat %s: %+v, %v", name, stat, err)
+		}
+	}
+
+	if err := kvtest.Put(ctx, store, "empty", nil); err != nil {
+		t.Fatalf("put empty: %s", err)
+	}
+	if stat, err := store.Stat(ctx, "empty"); err != nil || !stat.Exists || stat.Size != 0 {
+		t.Errorf("stat empty: %+v, %v", stat, err)
+	}
+}
+
+func TestREAPIStorageRejectedToken(t *testing.T) {
+	store, _ := newREAPIStorage(t, "wrong")
+	ctx := context.Background()
+
+	_, err := store.Stat(ctx, "main-archive")
+	if status.Code(err) != codes.Unauthenticated || kv.IsRetryable(err) {
+		t.Fatalf("stat with wrong token: %v, want a non-retryable Unauthenticated", err)
+	}
+	data := kvtest.RandomData(1024)
+	if err := kvtest.Put(ctx, store, "main-archive", data); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("put with wrong token: %v, want Unauthenticated", err)
+	}
+}
@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+)
+
+const (
+	// s3Sha256Metadata is the user metadata holding the sha256 of the whole
+	// object, as the ETag of multipart uploads isn't a checksum of the content.
+	s3Sha256Metadata = "X-Amz-Meta-Sha256"
+
+	// minS3PartSize is both the size of the parts of multipart uploads and
+	// the object size from which uploads are multipart.
+	minS3PartSize = 8 * 1024 * 1024
+	maxS3Parts    = 10000
+)
+
+// s3Storage stores every key as an object in an S3 bucket, or on an S3
+// compatible service (MinIO, Ceph, R2, ...). Large blobs are uploaded in
+// parts, so a failed upload only buffers one part in memory.
+type s3Storage struct {
+	client   *http.Client
+	endpoint *url.URL
+	// pathStyle addresses the bucket in the path rather than the host name,
+	// which S3 compatible services generally expect.
+	pathStyle bool
+	bucket    string
+	prefix    string
+	region    string
+	creds     awsCredentials
+}
+
+// NewS3Storage returns a Storage keeping blobs in bucket, under prefix.
+//
+// The configuration comes from the standard AWS environment variables:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+// AWS_REGION (or AWS_DEFAULT_REGION) and AWS_ENDPOINT_URL_S3 (or
+// AWS_ENDPOINT_URL) for S3 compatible services.
+func NewS3Storage(bucket, prefix string) (Storage, error) {
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("no S3 credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	s := &s3Storage{
+		client: &http.Client{},
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+		region: region,
+		creds:  creds,
+	}
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		parsed, err := url.Parse(endpoint)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		s.endpoint = parsed
+		s.pathStyle = true
+	} else {
+		s.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, region)}
+	}
+	return s, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// newRequest returns a request for the object of name, with query appended
+// to the URL. It is signed by do.
+func (s *s3Storage) newRequest(ctx context.Context, method, name string, query url.Values, body io.Reader) (*http.Request, error) {
+	key := name
+	if s.prefix != "" {
+		key = s.prefix + "/" + name
+	}
+	u := *s.endpoint
+	u.Path = "/" + key
+	if s.pathStyle {
+		u.Path = path.Join("/", s.endpoint.Path, s.bucket) + "/" + key
+	}
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "new request: %s", err)
+	}
+	return req, nil
+}
+
+func (s *s3Storage) do(req *http.Request, payloadSha256 string) (*http.Response, error) {
+	signV4(req, s.creds, s.region, payloadSha256, time.Now())
+	return doHTTP(s.client, req)
+}
+
+func (s *s3Storage) Put(ctx context.Context, p kv.PutParams) (kv.Writer, error) {
+	if p.Offset != 0 {
+		return nil, status.Error(codes.InvalidArgument, "s3 storage can't resume uploads")
+	}
+
+	if p.FileSize < minS3PartSize {
+		return &s3Writer{
+			ctx:      ctx,
+			storage:  s,
+			params:   p,
+			partSize: p.FileSize,
+		}, nil
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPost, p.Name, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.Sha256Sum != "" {
+		req.Header.Set(s3Sha256Metadata, p.Sha256Sum)
+	}
+	resp, err := s.do(req, emptyPayloadSha256)
+	if err != nil {
+		return nil, fmt.Errorf("create multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&created); err != nil || created.UploadID == "" {
+		return nil, status.Errorf(codes.Internal, "create multipart upload: invalid response: %v", err)
+	}
+
+	return &s3Writer{
+		ctx:      ctx,
+		storage:  s,
+		params:   p,
+		uploadID: created.UploadID,
+		// Parts are limited in number, not in size.
+		partSize: max(minS3PartSize, (p.FileSize+maxS3Parts-1)/maxS3Parts),
+	}, nil
+}
+
+// s3Writer buffers a part at a time: the whole object if it is uploaded with
+// a single PUT, otherwise the parts of a multipart upload.
+type s3Writer struct {
+	ctx      context.Context
+	storage  *s3Storage
+	params   kv.PutParams
+	uploadID string
+	partSize int64
+
+	buf     bytes.Buffer
+	written int64
+	parts   []s3Part
+	err     error
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.written+int64(len(p)) > w.params.FileSize {
+		return 0, status.Errorf(codes.InvalidArgument, "write exceeds the size of %d bytes", w.params.FileSize)
+	}
+
+	var n int
+	for len(p) > 0 {
+		chunk := p[:min(int64(len(p)), w.partSize-int64(w.buf.Len()))]
+		w.buf.Write(chunk)
+		n += len(chunk)
+		p = p[len(chunk):]
+		if w.uploadID != "" && int64(w.buf.Len()) == w.partSize && w.written+int64(n) < w.params.FileSize {
+			if err := w.uploadPart(); err != nil {
+				w.err = err
+				w.abort()
+				return n, err
+			}
+		}
+	}
+	w.written += int64(n)
+	return n, nil
+}
+
+func (w *s3Writer) uploadPart() error {
+	number := len(w.parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadID},
+	}
+	req, err := w.storage.newRequest(w.ctx, http.MethodPut, w.params.Name, query, bytes.NewReader(w.buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(w.buf.Bytes())
+	resp, err := w.storage.do(req, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return fmt.Errorf("upload part %d: %w", number, err)
+	}
+	resp.Body.Close()
+
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	w.buf.Reset()
+	return nil
+}
+
+// Close uploads the object, or the last part and completes the multipart
+// upload. Incomplete multipart uploads are aborted.
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.written != w.params.FileSize {
+		w.abort()
+		return status.Errorf(codes.InvalidArgument, "wrote %d of %d bytes", w.written, w.params.FileSize)
+	}
+
+	if w.uploadID == "" {
+		return w.putObject()
+	}
+	if err := w.uploadPart(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.complete(); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+func (w *s3Writer) putObject() error {
+	req, err := w.storage.newRequest(w.ctx, http.MethodPut, w.params.Name, nil, bytes.NewReader(w.buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	// S3 verifies the signed payload checksum, so it rejects corrupted uploads.
+	payloadSha256 := unsignedPayload
+	if w.params.Sha256Sum != "" {
+		req.Header.Set(s3Sha256Metadata, w.params.Sha256Sum)
+		payloadSha256 = w.params.Sha256Sum
+	}
+	resp, err := w.storage.do(req, payloadSha256)
+	if err != nil {
+		return fmt.Errorf("put object: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *s3Writer) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	req, err := w.storage.newRequest(w.ctx, http.MethodPost, w.params.Name, url.Values{"uploadId": {w.uploadID}}, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	resp, err := w.storage.do(req, hex.EncodeToString(sum[:]))
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Completing can fail after a 200 response, with an error in the body.
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return status.Errorf(codes.Unavailable, "complete multipart upload: invalid response: %s", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return status.Errorf(codes.Internal, "complete multipart upload: %s: %s", result.Code, result.Message)
+	}
+	return nil
+}
+
+// Abort aborts the multipart upload, if any. Nothing is uploaded otherwise
+// until Close.
+func (w *s3Writer) Abort() error {
+	w.err = status.Error(codes.Aborted, "upload aborted")
+	w.buf.Reset()
+	w.abort()
+	return nil
+}
+
+// abort removes the uploaded parts. It is best effort: buckets should have a
+// lifecycle rule cleaning up incomplete multipart uploads anyway.
+func (w *s3Writer) abort() {
+	if w.uploadID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(w.ctx), 10*time.Second)
+	defer cancel()
+	req, err := w.storage.newRequest(ctx, http.MethodDelete, w.params.Name, url.Values{"uploadId": {w.uploadID}}, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := w.storage.do(req, emptyPayloadSha256); err == nil {
+		resp.Body.Close()
+	}
+	w.uploadID = ""
+}
+
+func (s *s3Storage) Get(ctx context.Context, p kv.GetParams) (kv.Reader, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, p.Name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRange(req, p)
+
+	resp, err := s.do(req, emptyPayloadSha256)
+	if err != nil {
+		return nil, err
+	}
+	return newRangeReader(resp, p, resp.Header.Get(s3Sha256Metadata))
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (kv.StatResult, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, name, nil, nil)
+	if err != nil {
+		return kv.StatResult{}, err
+	}
+	resp, err := s.do(req, emptyPayloadSha256)
+	if status.Code(err) == codes.NotFound {
+		return kv.StatResult{}, nil
+	}
+	if err != nil {
+		return kv.StatResult{}, err
+	}
+	resp.Body.Close()
+
+	return kv.StatResult{
+		Exists:    true,
+		Size:      resp.ContentLength,
+		Sha256Sum: resp.Header.Get(s3Sha256Metadata),
+	}, nil
+}
+
+// Delete removes the object. S3 doesn't tell whether a deleted object
+// existed, so it is checked first.
+func (s *s3Storage) Delete(ctx context.Context, name string) (bool, error) {
+	stat, err := s.Stat(ctx, name)
+	if err != nil || !stat.Exists {
+		return false, err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do(req, emptyPayloadSha256)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *s3Storage) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
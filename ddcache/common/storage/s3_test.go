@@ -0,0 +1,237 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+)
+
+// s3Server is a stand-in for an S3 compatible service with path-style
+// addressing, covering the requests the s3 backend makes.
+type s3Server struct {
+	mu       sync.Mutex
+	objects  map[string]s3Object
+	uploads  map[string]map[int][]byte
+	metadata map[string]string
+	parts    int
+}
+
+type s3Object struct {
+	data   []byte
+	sha256 string
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if payload := r.Header.Get("X-Amz-Content-Sha256"); payload != "UNSIGNED-PAYLOAD" && payload != kvtest.Sha256Hex(body) {
+		http.Error(w, "<Error><Code>XAmzContentSHA256Mismatch</Code></Error>", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := strconv.Itoa(len(s.uploads) + 1)
+		s.uploads[uploadID] = map[int][]byte{}
+		s.metadata[uploadID] = r.Header.Get("X-Amz-Meta-Sha256")
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		s.uploads[query.Get("uploadId")][number] = body
+		s.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parts := s.uploads[query.Get("uploadId")]
+		var data []byte
+		for _, part := range complete.Parts {
+			if part.ETag != fmt.Sprintf(`"part-%d"`, part.PartNumber) {
+				http.Error(w, "<Error><Code>InvalidPart</Code></Error>", http.StatusBadRequest)
+				return
+			}
+			data = append(data, parts[part.PartNumber]...)
+		}
+		s.objects[key] = s3Object{data: data, sha256: s.metadata[query.Get("uploadId")]}
+		delete(s.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		s.objects[key] = s3Object{data: body, sha256: r.Header.Get("X-Amz-Meta-Sha256")}
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		object, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Amz-Meta-Sha256", object.sha256)
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(object.data))
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newS3Storage(t *testing.T) (storage.Storage, *s3Server) {
+	t.Helper()
+
+	server := &s3Server{
+		objects:  map[string]s3Object{},
+		uploads:  map[string]map[int][]byte{},
+		metadata: map[string]string{},
+	}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ENDPOINT_URL_S3", httpServer.URL)
+	store, err := storage.New(context.Background(), "s3://bucket/ddcache", kv.NewClientParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, server
+}
+
+func TestS3StorageRoundTrip(t *testing.T) {
+	for _, size := range []int{1024, 20*1024*1024 + 5} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			store, server := newS3Storage(t)
+			ctx := context.Background()
+			data := kvtest.RandomData(size)
+
+			if err := kvtest.Put(ctx, store, "feature/x-archive", data); err != nil {
+				t.Fatalf("put: %s", err)
+			}
+			if size > 8*1024*1024 && server.parts != 3 {
+				t.Errorf("uploaded %d parts, want 3", server.parts)
+			}
+			if object := server.objects["ddcache/feature/x-archive"]; !bytes.Equal(object.data, data) {
+				t.Fatalf("stored %d bytes, want %d matching bytes", len(object.data), len(data))
+			}
+
+			stat, err := store.Stat(ctx, "feature/x-archive")
+			if err != nil {
+				t.Fatalf("stat: %s", err)
+			}
+			if !stat.Exists || stat.Size != int64(size) || stat.Sha256Sum != kvtest.Sha256Hex(data) {
+				t.Errorf("got stat %+v", stat)
+			}
+
+			r, err := store.Get(ctx, kv.GetParams{Name: "feature/x-archive", Offset: 100, Limit: 500})
+			if err != nil {
+				t.Fatalf("get: %s", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read: %s", err)
+			}
+			if !bytes.Equal(got, data[100:600]) {
+				t.Errorf("got %d bytes, want bytes 100-600", len(got))
+			}
+
+			if deleted, err := store.Delete(ctx, "feature/x-archive"); err != nil || !deleted {
+				t.Fatalf("delete: %t, %v", deleted, err)
+			}
+			if deleted, err := store.Delete(ctx, "feature/x-archive"); err != nil || deleted {
+				t.Fatalf("second delete: %t, %v", deleted, err)
+			}
+		})
+	}
+}
+
+func TestS3StorageAbort(t *testing.T) {
+	store, server := newS3Storage(t)
+	data := kvtest.RandomData(20 * 1024 * 1024)
+
+	w, err := store.Put(context.Background(), kv.PutParams{
+		Name:      "main-archive",
+		Sha256Sum: kvtest.Sha256Hex(data),
+		FileSize:  int64(len(data)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:10*1024*1024]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("abort: %s", err)
+	}
+
+	if len(server.uploads) != 0 {
+		t.Errorf("%d multipart uploads weren't aborted", len(server.uploads))
+	}
+	if _, ok := server.objects["ddcache/main-archive"]; ok {
+		t.Error("aborted upload was stored")
+	}
+}
+
+func TestS3StorageAbortsIncompleteUpload(t *testing.T) {
+	store, server := newS3Storage(t)
+	data := kvtest.RandomData(20 * 1024 * 1024)
+
+	w, err := store.Put(context.Background(), kv.PutParams{
+		Name:      "main-archive",
+		Sha256Sum: kvtest.Sha256Hex(data),
+		FileSize:  int64(len(data)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:10*1024*1024]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("closing an incomplete upload succeeded")
+	}
+
+	if len(server.uploads) != 0 {
+		t.Errorf("%d multipart uploads weren't aborted", len(server.uploads))
+	}
+	if _, ok := server.objects["ddcache/main-archive"]; ok {
+		t.Error("incomplete upload was stored")
+	}
+}
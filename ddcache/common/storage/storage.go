@@ -0,0 +1,119 @@
+// Package storage abstracts the cache backends ddcache-save, ddcache-restore
+// and ddcache-delete work with, so that the backend is picked by the scheme
+// of the service URL.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+)
+
+// Storage stores blobs under keys.
+//
+// Implementations report failures as gRPC status errors, like kv.Client does,
+// so that kv.IsRetryable and codes.NotFound checks work the same way for
+// every backend.
+type Storage interface {
+	// Put returns a writer storing p.FileSize bytes under p.Name. The blob
+	// is only stored once the writer is closed after all bytes were written.
+	// Uploads which can't be finished must be aborted instead, which
+	// discards the partial data and releases the resources of the upload.
+	Put(ctx context.Context, p kv.PutParams) (kv.Writer, error)
+	// Get reads the blob stored under p.Name, or a range of it.
+	Get(ctx context.Context, p kv.GetParams) (kv.Reader, error)
+	// Stat reports whether a blob is stored under name, and its size.
+	Stat(ctx context.Context, name string) (kv.StatResult, error)
+	// Delete removes the blob stored under name. It reports whether it existed.
+	Delete(ctx context.Context, name string) (bool, error)
+	Close() error
+}
+
+// Resumable is implemented by the backends which keep the data of an
+// interrupted Put, which can then be continued from the committed size.
+type Resumable interface {
+	QueryWriteStatus(ctx context.Context, name string) (kv.WriteStatus, error)
+}
+
+var _ Storage = (*kv.Client)(nil)
+var _ Resumable = (*kv.Client)(nil)
+
+// New returns the backend for serviceURL:
+//
+//	grpc://host:port, grpcs://host:port   the KVStorage service
+//	file:///path/to/dir                   a local or network-mounted directory
+//	http[s]://host[:port][/path]          a generic HTTP object cache
+//	s3://bucket[/prefix]                  an S3 (compatible) bucket
+//	reapi[s]://host:port[/instance]       a Remote Execution API cache
+//
+// params configure authentication and TLS; the connection related fields are
+// set from serviceURL.
+func New(ctx context.Context, serviceURL string, params kv.NewClientParams) (Storage, error) {
+	parsed, err := url.Parse(serviceURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse service url: %w", err)
+	}
+
+	switch parsed.Scheme {
+	case "grpc", "grpcs":
+		return newKVClient(ctx, serviceURL, params)
+	case "file":
+		if parsed.Host != "" || parsed.Path == "" {
+			return nil, fmt.Errorf("the url file:///path format, %q is invalid", serviceURL)
+		}
+		return NewFileStorage(filepath.FromSlash(parsed.Path))
+	case "http", "https":
+		return NewHTTPStorage(serviceURL, params)
+	case "s3":
+		if parsed.Host == "" {
+			return nil, fmt.Errorf("the url s3://bucket[/prefix] format, %q is invalid", serviceURL)
+		}
+		return NewS3Storage(parsed.Host, parsed.Path)
+	case "reapi", "reapis":
+		host, insecureGRPC, instanceName, err := parseREAPIURL(serviceURL)
+		if err != nil {
+			return nil, err
+		}
+		params.UseInsecure = insecureGRPC
+		params.Host = host
+		params.DialTimeout = 5 * time.Second
+		return NewREAPIStorage(ctx, instanceName, params)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in service url %q", parsed.Scheme, serviceURL)
+	}
+}
+
+// RequiresToken reports whether the backend for serviceURL can't be used
+// without an access token. Directories, HTTP and REAPI caches may not need
+// one, S3 uses AWS credentials instead.
+func RequiresToken(serviceURL string) bool {
+	parsed, err := url.Parse(serviceURL)
+	if err != nil {
+		return true
+	}
+	return parsed.Scheme == "grpc" || parsed.Scheme == "grpcs"
+}
+
+func newKVClient(ctx context.Context, cacheUrl string, params kv.NewClientParams) (*kv.Client, error) {
+	buildCacheHost, insecureGRPC, err := kv.ParseUrlGRPC(cacheUrl)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"the url grpc[s]://host:port format, %q is invalid: %w",
+			cacheUrl, err,
+		)
+	}
+
+	params.UseInsecure = insecureGRPC
+	params.Host = buildCacheHost
+	params.DialTimeout = 5 * time.Second
+	params.ClientName = "kv"
+	kvClient, err := kv.NewClient(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("new kv client: %w", err)
+	}
+	return kvClient, nil
+}
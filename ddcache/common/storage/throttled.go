@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/throttle"
+)
+
+// Throttle limits the bandwidth of all the uploads and downloads of store,
+// including parallel ones, to the rates of upload and download. Nil limiters
+// leave that direction unlimited.
+func Throttle(store Storage, upload, download *throttle.Limiter) Storage {
+	if upload == nil && download == nil {
+		return store
+	}
+	throttled := &throttledStorage{Storage: store, upload: upload, download: download}
+	if resumable, ok := store.(Resumable); ok {
+		return &resumableThrottledStorage{throttledStorage: throttled, resumable: resumable}
+	}
+	return throttled
+}
+
+type throttledStorage struct {
+	Storage
+	upload   *throttle.Limiter
+	download *throttle.Limiter
+}
+
+func (s *throttledStorage) Put(ctx context.Context, p kv.PutParams) (kv.Writer, error) {
+	w, err := s.Storage.Put(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return s.upload.Writer(ctx, w), nil
+}
+
+func (s *throttledStorage) Get(ctx context.Context, p kv.GetParams) (kv.Reader, error) {
+	r, err := s.Storage.Get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return s.download.Reader(ctx, r), nil
+}
+
+// resumableThrottledStorage keeps resuming uploads to Resumable backends.
+type resumableThrottledStorage struct {
+	*throttledStorage
+	resumable Resumable
+}
+
+func (s *resumableThrottledStorage) QueryWriteStatus(ctx context.Context, name string) (kv.WriteStatus, error) {
+	return s.resumable.QueryWriteStatus(ctx, name)
+}
@@ -0,0 +1,30 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/throttle"
+)
+
+func TestThrottleKeepsResumable(t *testing.T) {
+	server := kvtest.NewServer(t)
+	server.SetBlob("kv/key", []byte("data"))
+	client := server.NewClient(t)
+	fileStore, _ := newFileStorage(t)
+	limiter := throttle.NewLimiter(1024 * 1024)
+
+	if _, ok := storage.Throttle(fileStore, limiter, limiter).(storage.Resumable); ok {
+		t.Error("throttled file storage is Resumable")
+	}
+	resumable, ok := storage.Throttle(client, limiter, limiter).(storage.Resumable)
+	if !ok {
+		t.Fatal("throttled kv client isn't Resumable")
+	}
+	status, err := resumable.QueryWriteStatus(context.Background(), "key")
+	if err != nil || !status.Complete || status.CommittedSize != 4 {
+		t.Errorf("QueryWriteStatus() = %+v, %v, want the stored blob", status, err)
+	}
+}
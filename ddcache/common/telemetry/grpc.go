@@ -0,0 +1,281 @@
+package telemetry
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The attributes of spans and metrics, named after the OpenTelemetry RPC
+// semantic conventions where one exists.
+const (
+	rpcSystemKey     = attribute.Key("rpc.system")
+	rpcServiceKey    = attribute.Key("rpc.service")
+	rpcMethodKey     = attribute.Key("rpc.method")
+	rpcStatusCodeKey = attribute.Key("rpc.grpc.status_code")
+	serverAddressKey = attribute.Key("server.address")
+	sentBytesKey     = attribute.Key("ddcache.sent_bytes")
+	receivedBytesKey = attribute.Key("ddcache.received_bytes")
+	// sendWaitKey and recvWaitKey are the seconds a stream was blocked
+	// sending to or receiving from the service. The rest of its duration was
+	// spent by the client, e.g. reading or writing files.
+	sendWaitKey = attribute.Key("ddcache.send_wait")
+	recvWaitKey = attribute.Key("ddcache.recv_wait")
+)
+
+// instruments are created when a connection is dialed, so that they come
+// from the providers installed by Setup.
+type instruments struct {
+	duration  metric.Float64Histogram
+	firstByte metric.Float64Histogram
+	sent      metric.Int64Counter
+	received  metric.Int64Counter
+}
+
+func newInstruments() *instruments {
+	m := meter()
+	// The instruments are no-ops if creating them fails, the error is
+	// reported to the global error handler.
+	duration, _ := m.Float64Histogram("ddcache.rpc.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of gRPC calls, until the last message of streams."))
+	firstByte, _ := m.Float64Histogram("ddcache.rpc.first_byte",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time from starting a server streaming gRPC call to receiving its first message."))
+	sent, _ := m.Int64Counter("ddcache.rpc.sent_bytes",
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of the messages sent by gRPC calls."))
+	received, _ := m.Int64Counter("ddcache.rpc.received_bytes",
+		metric.WithUnit("By"),
+		metric.WithDescription("Size of the messages received by gRPC calls."))
+	return &instruments{
+		duration:  duration,
+		firstByte: firstByte,
+		sent:      sent,
+		received:  received,
+	}
+}
+
+// DialOptions instrument the calls of a connection to target with spans and
+// metrics.
+func DialOptions(target string) []grpc.DialOption {
+	inst := newInstruments()
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(inst.unaryInterceptor(target)),
+		grpc.WithChainStreamInterceptor(inst.streamInterceptor(target)),
+	}
+}
+
+func (inst *instruments) unaryInterceptor(target string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, c := inst.start(ctx, target, method)
+		c.sent(req)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil {
+			c.received(reply)
+		}
+		c.end(err)
+		return err
+	}
+}
+
+func (inst *instruments) streamInterceptor(target string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, c := inst.start(ctx, target, method)
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			c.end(err)
+			return nil, err
+		}
+		// Readers abandoned before the end of the stream are only done once
+		// their context is.
+		stop := context.AfterFunc(ctx, func() {
+			c.end(status.FromContextError(ctx.Err()).Err())
+		})
+		return &clientStream{ClientStream: stream, call: c, serverStreams: desc.ServerStreams, stop: stop}, nil
+	}
+}
+
+func (inst *instruments) start(ctx context.Context, target, method string) (context.Context, *call) {
+	service, name, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	attrs := []attribute.KeyValue{
+		rpcSystemKey.String("grpc"),
+		rpcServiceKey.String(service),
+		rpcMethodKey.String(name),
+	}
+	ctx, span := tracer().Start(ctx, strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+		trace.WithAttributes(serverAddressKey.String(target)))
+	return ctx, &call{
+		ctx:   ctx,
+		inst:  inst,
+		span:  span,
+		attrs: attrs,
+		start: time.Now(),
+	}
+}
+
+// call is a gRPC call in progress. Streams may send and receive
+// concurrently, and be ended by their context meanwhile.
+type call struct {
+	ctx   context.Context
+	inst  *instruments
+	span  trace.Span
+	attrs []attribute.KeyValue
+	start time.Time
+
+	sentBytes     atomic.Int64
+	receivedBytes atomic.Int64
+	sendWait      atomic.Int64
+	recvWait      atomic.Int64
+	firstByte     sync.Once
+	ended         sync.Once
+}
+
+func (c *call) sent(msg any) {
+	if m, ok := msg.(proto.Message); ok {
+		c.sentBytes.Add(int64(proto.Size(m)))
+	}
+}
+
+func (c *call) received(msg any) {
+	if m, ok := msg.(proto.Message); ok {
+		c.receivedBytes.Add(int64(proto.Size(m)))
+	}
+}
+
+func (c *call) end(err error) {
+	c.ended.Do(func() {
+		code := status.Code(err)
+		attrs := metric.WithAttributes(append(c.attrs, rpcStatusCodeKey.Int(int(code)))...)
+		c.inst.duration.Record(c.ctx, time.Since(c.start).Seconds(), attrs)
+		c.inst.sent.Add(c.ctx, c.sentBytes.Load(), attrs)
+		c.inst.received.Add(c.ctx, c.receivedBytes.Load(), attrs)
+
+		c.span.SetAttributes(
+			rpcStatusCodeKey.Int(int(code)),
+			sentBytesKey.Int64(c.sentBytes.Load()),
+			receivedBytesKey.Int64(c.receivedBytes.Load()),
+			sendWaitKey.Float64(time.Duration(c.sendWait.Load()).Seconds()),
+			recvWaitKey.Float64(time.Duration(c.recvWait.Load()).Seconds()),
+		)
+		if code != codes.OK {
+			c.span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+		}
+		c.span.End()
+	})
+}
+
+type clientStream struct {
+	grpc.ClientStream
+	call          *call
+	serverStreams bool
+	stop          func() bool
+}
+
+func (s *clientStream) end(err error) {
+	s.stop()
+	s.call.end(err)
+}
+
+func (s *clientStream) SendMsg(m any) error {
+	start := time.Now()
+	err := s.ClientStream.SendMsg(m)
+	s.call.sendWait.Add(int64(time.Since(start)))
+	if err != nil {
+		// The reason is reported by RecvMsg.
+		return err
+	}
+	s.call.sent(m)
+	return nil
+}
+
+func (s *clientStream) RecvMsg(m any) error {
+	start := time.Now()
+	err := s.ClientStream.RecvMsg(m)
+	s.call.recvWait.Add(int64(time.Since(start)))
+	switch {
+	case err == io.EOF:
+		s.end(nil)
+	case err != nil:
+		s.end(err)
+	default:
+		s.call.received(m)
+		if s.serverStreams {
+			s.call.firstByte.Do(func() {
+				elapsed := time.Since(s.call.start)
+				s.call.inst.firstByte.Record(s.call.ctx, elapsed.Seconds(), metric.WithAttributes(s.call.attrs...))
+				s.call.span.AddEvent("first byte")
+			})
+		} else {
+			// Client streams end with their single response.
+			s.end(nil)
+		}
+	}
+	return err
+}
+
+// ObserveConnect records how long conn takes to connect to target, every
+// time it connects, as the ddcache.connect.duration metric and a span. It
+// stops once conn is closed.
+func ObserveConnect(conn *grpc.ClientConn, target string) {
+	duration, _ := meter().Float64Histogram("ddcache.connect.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time from starting to connect to the service until the connection is ready."))
+	attrs := []attribute.KeyValue{serverAddressKey.String(target)}
+
+	go func() {
+		ctx := context.Background()
+		var span trace.Span
+		var start time.Time
+		for state := conn.GetState(); state != connectivity.Shutdown; state = conn.GetState() {
+			switch {
+			case state != connectivity.Idle && state != connectivity.Ready && span == nil:
+				start = time.Now()
+				_, span = tracer().Start(ctx, "connect",
+					trace.WithTimestamp(start),
+					trace.WithSpanKind(trace.SpanKindClient),
+					trace.WithAttributes(attrs...))
+			case state == connectivity.TransientFailure && span != nil:
+				span.AddEvent("transient failure")
+			case state == connectivity.Ready && span != nil:
+				duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attrs...))
+				span.End()
+				span = nil
+			}
+			conn.WaitForStateChange(ctx, state)
+		}
+		if span != nil {
+			span.SetStatus(otelcodes.Error, "closed before connecting")
+			span.End()
+		}
+	}()
+}
+
+// RecordRetry counts a retry after err as the ddcache.retries metric, and
+// adds it to the span of ctx.
+func RecordRetry(ctx context.Context, attempt int, err error) {
+	retries, _ := meter().Int64Counter("ddcache.retries",
+		metric.WithDescription("Attempts retried after transient failures."))
+	code := rpcStatusCodeKey.Int(int(status.Code(err)))
+	retries.Add(ctx, 1, metric.WithAttributes(code))
+	trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+		attribute.Int("ddcache.attempt", attempt+1),
+		code,
+		attribute.String("exception.message", err.Error()),
+	))
+}
@@ -0,0 +1,167 @@
+// Package telemetry traces and measures the gRPC calls of the cache clients
+// with OpenTelemetry, and exports the spans and metrics to an OTLP collector
+// or to a local JSON file.
+//
+// The instrumentation uses the global OpenTelemetry providers, which discard
+// everything until Setup installs exporting ones.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/bitrise-io/xcodebuild-cache-tools/ddcache"
+
+// shutdownTimeout bounds flushing the last spans and metrics, which also
+// happens after the time budget of a command ran out.
+const shutdownTimeout = 10 * time.Second
+
+type Config struct {
+	// ServiceName identifies the command in the exported data.
+	ServiceName string
+	// Endpoint is the URL of an OTLP/gRPC collector, e.g.
+	// http://localhost:4317, or empty.
+	Endpoint string
+	// File is a path the spans and metrics are appended to as JSON lines,
+	// or empty.
+	File   string
+	Logger log.Logger
+}
+
+// Telemetry exports the spans and metrics recorded by the process. A nil
+// Telemetry exports nothing.
+type Telemetry struct {
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	file           *os.File
+	logger         log.Logger
+}
+
+// Setup installs the global providers exporting to the endpoint and the file
+// of cfg. It returns nil if neither is set.
+func Setup(ctx context.Context, cfg Config) (*Telemetry, error) {
+	if cfg.Endpoint == "" && cfg.File == "" {
+		return nil, nil
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))
+	traceOpts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	meterOpts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+	t := &Telemetry{logger: cfg.Logger}
+
+	if cfg.Endpoint != "" {
+		spanExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(cfg.Endpoint))
+		if err != nil {
+			return nil, fmt.Errorf("telemetry endpoint %s: %w", cfg.Endpoint, err)
+		}
+		metricExporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(cfg.Endpoint))
+		if err != nil {
+			return nil, fmt.Errorf("telemetry endpoint %s: %w", cfg.Endpoint, err)
+		}
+		traceOpts = append(traceOpts, sdktrace.WithBatcher(spanExporter))
+		meterOpts = append(meterOpts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)))
+	}
+
+	if cfg.File != "" {
+		file, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("telemetry file: %w", err)
+		}
+		t.file = file
+		// The exporters encode whole lines, but flush them concurrently.
+		w := &syncWriter{w: file}
+		spanExporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("telemetry file: %w", err)
+		}
+		metricExporter, err := stdoutmetric.New(stdoutmetric.WithWriter(w))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("telemetry file: %w", err)
+		}
+		traceOpts = append(traceOpts, sdktrace.WithBatcher(spanExporter))
+		meterOpts = append(meterOpts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)))
+	}
+
+	t.tracerProvider = sdktrace.NewTracerProvider(traceOpts...)
+	t.meterProvider = sdkmetric.NewMeterProvider(meterOpts...)
+	otel.SetTracerProvider(t.tracerProvider)
+	otel.SetMeterProvider(t.meterProvider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		cfg.Logger.Debugf("Telemetry: %s", err)
+	}))
+	return t, nil
+}
+
+// Shutdown exports what is left of the spans and metrics. Spans still open
+// are dropped. Failures are only logged, telemetry doesn't fail commands.
+func (t *Telemetry) Shutdown() {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := errors.Join(t.tracerProvider.Shutdown(ctx), t.meterProvider.Shutdown(ctx))
+	if t.file != nil {
+		err = errors.Join(err, t.file.Close())
+	}
+	if err != nil {
+		t.logger.Warnf("Failed to export telemetry: %s", err)
+	}
+}
+
+// Start starts a span of the command, e.g. the download of a key, which the
+// spans of its gRPC calls become children of.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, recording err if it failed.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+func meter() metric.Meter {
+	return otel.Meter(instrumentationName)
+}
+
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,205 @@
+package telemetry_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/codes"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/telemetry"
+)
+
+// recordTelemetry installs global providers keeping the spans and metrics in
+// memory for the duration of the test.
+func recordTelemetry(t *testing.T) (*tracetest.SpanRecorder, *sdkmetric.ManualReader) {
+	spans := tracetest.NewSpanRecorder()
+	metrics := sdkmetric.NewManualReader()
+	tracerProvider, meterProvider := otel.GetTracerProvider(), otel.GetMeterProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(metrics)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetMeterProvider(meterProvider)
+	})
+	return spans, metrics
+}
+
+func getAll(t *testing.T, client *kv.Client, name string) []byte {
+	t.Helper()
+	r, err := client.Get(context.Background(), kv.GetParams{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGetSpansAndMetrics(t *testing.T) {
+	spans, metrics := recordTelemetry(t)
+	server := kvtest.NewServer(t)
+	server.SetBlob("kv/key", []byte(strings.Repeat("x", 1000)))
+	client := server.NewClient(t)
+
+	ctx, span := telemetry.Start(context.Background(), "download")
+	err := kv.RetryPolicy{MaxAttempts: 2}.Do(ctx, func(attempt int) error {
+		if attempt == 0 {
+			server.FailNext(codes.Unavailable, 1)
+		}
+		r, err := client.Get(ctx, kv.GetParams{Name: "key"})
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(io.Discard, r)
+		return err
+	})
+	telemetry.End(span, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gets []sdktrace.ReadOnlySpan
+	var download sdktrace.ReadOnlySpan
+	for _, s := range spans.Ended() {
+		switch s.Name() {
+		case "kv_storage.KVStorage/Get":
+			gets = append(gets, s)
+		case "download":
+			download = s
+		}
+	}
+	if len(gets) != 2 || download == nil {
+		t.Fatalf("got %d Get spans and download span %v, want 2 and one", len(gets), download)
+	}
+	if code := attributeValue(gets[0].Attributes(), "rpc.grpc.status_code"); code.AsInt64() != int64(codes.Unavailable) {
+		t.Errorf("failed Get has status code %v", code.Emit())
+	}
+	ok := gets[1]
+	if ok.Parent().SpanID() != download.SpanContext().SpanID() {
+		t.Error("Get span isn't a child of the download span")
+	}
+	if received := attributeValue(ok.Attributes(), "ddcache.received_bytes").AsInt64(); received < 1000 {
+		t.Errorf("received %d bytes, want at least 1000", received)
+	}
+	if len(ok.Events()) != 1 || ok.Events()[0].Name != "first byte" {
+		t.Errorf("Get span events %v, want first byte", ok.Events())
+	}
+	if len(download.Events()) != 1 || download.Events()[0].Name != "retry" {
+		t.Errorf("download span events %v, want retry", download.Events())
+	}
+
+	var data metricdata.ResourceMetrics
+	if err := metrics.Collect(context.Background(), &data); err != nil {
+		t.Fatal(err)
+	}
+	var firstBytes uint64
+	var retries int64
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			switch m.Name {
+			case "ddcache.rpc.first_byte":
+				for _, p := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+					firstBytes += p.Count
+				}
+			case "ddcache.retries":
+				for _, p := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					retries += p.Value
+				}
+			}
+		}
+	}
+	if firstBytes != 1 || retries != 1 {
+		t.Errorf("recorded %d first bytes and %d retries, want 1 and 1", firstBytes, retries)
+	}
+}
+
+func attributeValue(attrs []attribute.KeyValue, key attribute.Key) attribute.Value {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestSetupWritesFile(t *testing.T) {
+	tracerProvider, meterProvider := otel.GetTracerProvider(), otel.GetMeterProvider()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetMeterProvider(meterProvider)
+	})
+	path := filepath.Join(t.TempDir(), "telemetry.json")
+	tel, err := telemetry.Setup(context.Background(), telemetry.Config{
+		ServiceName: "ddcache-test",
+		File:        path,
+		Logger:      log.NewLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := kvtest.NewServer(t)
+	server.SetBlob("kv/key", []byte("data"))
+	client := server.NewClient(t)
+	if got := string(getAll(t, client, "key")); got != "data" {
+		t.Fatalf("got %q", got)
+	}
+	tel.Shutdown()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	spans := map[string]bool{}
+	var metrics struct{ ScopeMetrics []any }
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var line map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid line %q: %s", scanner.Text(), err)
+		}
+		if _, ok := line["SpanContext"]; ok {
+			var span struct{ Name string }
+			json.Unmarshal(scanner.Bytes(), &span)
+			spans[span.Name] = true
+		}
+		if _, ok := line["ScopeMetrics"]; ok {
+			json.Unmarshal(scanner.Bytes(), &metrics)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !spans["kv_storage.KVStorage/Get"] || len(metrics.ScopeMetrics) == 0 {
+		t.Fatalf("file has spans %v and %d metric scopes, want the Get span and metrics", spans, len(metrics.ScopeMetrics))
+	}
+}
+
+func TestSetupDisabled(t *testing.T) {
+	tel, err := telemetry.Setup(context.Background(), telemetry.Config{ServiceName: "ddcache-test"})
+	if err != nil || tel != nil {
+		t.Fatalf("got %v, %v, want nothing set up", tel, err)
+	}
+	tel.Shutdown()
+}
@@ -0,0 +1,188 @@
+// Package throttle limits the bandwidth of transfers with a token bucket,
+// which is shared by all the streams it wraps.
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+)
+
+// minBurst keeps low rates from splitting transfers into tiny pieces.
+const minBurst = 64 * 1024
+
+// ParseRate parses a rate in bytes per second with units, e.g. "10MB",
+// "500KiB" or "10MB/s". An empty rate, or 0, means unlimited.
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if s == "" {
+		return 0, nil
+	}
+	rate, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %w", s, err)
+	}
+	return int64(rate), nil
+}
+
+// Limiter is a token bucket of bytes. Transfers may take more than the bucket
+// holds, putting it in debt, which the next transfers wait out. A nil
+// Limiter doesn't limit anything.
+type Limiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of bytesPerSecond, or nil if it isn't positive.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return newLimiter(bytesPerSecond, time.Now, sleep)
+}
+
+func newLimiter(bytesPerSecond int64, now func() time.Time, sleep func(context.Context, time.Duration) error) *Limiter {
+	burst := max(float64(bytesPerSecond)/10, minBurst)
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		now:    now,
+		sleep:  sleep,
+		tokens: burst,
+		last:   now(),
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// WaitN takes n bytes from the bucket, and waits until the bucket is out of
+// debt.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	return l.sleep(ctx, wait)
+}
+
+// Writer limits the bytes written to w. It keeps the io.ReaderFrom of w.
+func (l *Limiter) Writer(ctx context.Context, w kv.Writer) kv.Writer {
+	if l == nil {
+		return w
+	}
+	return &writer{ctx: ctx, w: w, limiter: l}
+}
+
+// Reader limits the bytes read from r. It keeps the io.WriterTo of r.
+func (l *Limiter) Reader(ctx context.Context, r kv.Reader) kv.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{Reader: r, ctx: ctx, limiter: l}
+}
+
+type writer struct {
+	ctx     context.Context
+	w       kv.Writer
+	limiter *Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.limiter.WaitN(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+func (w *writer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.w, limitedReader{ctx: w.ctx, r: r, limiter: w.limiter})
+}
+
+func (w *writer) Close() error {
+	return w.w.Close()
+}
+
+func (w *writer) Abort() error {
+	return w.w.Abort()
+}
+
+type reader struct {
+	kv.Reader
+	ctx     context.Context
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+func (r *reader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(limitedWriter{ctx: r.ctx, w: w, limiter: r.limiter}, r.Reader)
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *Limiter
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *Limiter
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	if err := w.limiter.WaitN(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
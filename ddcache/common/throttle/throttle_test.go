@@ -0,0 +1,108 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]int64{
+		"":         0,
+		"0":        0,
+		"10MB":     10_000_000,
+		"10 MB/s":  10_000_000,
+		"500KiB":   500 * 1024,
+		"1.5GiB/s": 1536 * 1024 * 1024,
+	} {
+		got, err := ParseRate(s)
+		if err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	if _, err := ParseRate("fast"); err == nil {
+		t.Error("ParseRate(\"fast\") succeeded")
+	}
+}
+
+func TestLimiterWaitsOutDebt(t *testing.T) {
+	now := time.Unix(0, 0)
+	var waits []time.Duration
+	limiter := newLimiter(1_000_000, func() time.Time { return now }, func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		now = now.Add(d)
+		return nil
+	})
+	ctx := context.Background()
+
+	// The initial burst of 100KB, then 500KB in debt, then 100KB once the debt is paid.
+	for _, n := range []int{100_000, 500_000, 100_000} {
+		if err := limiter.WaitN(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []time.Duration{500 * time.Millisecond, 100 * time.Millisecond}
+	if len(waits) != len(want) || waits[0] != want[0] || waits[1] != want[1] {
+		t.Fatalf("waited %v, want %v", waits, want)
+	}
+
+	// Idle time refills the bucket up to the burst only.
+	now = now.Add(time.Hour)
+	waits = nil
+	if err := limiter.WaitN(ctx, 300_000); err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 1 || waits[0] != 200*time.Millisecond {
+		t.Fatalf("waited %v after idling, want 200ms", waits)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (nopWriteCloser) Abort() error {
+	return nil
+}
+
+func TestLimiterIsSharedByStreams(t *testing.T) {
+	limiter := NewLimiter(2_000_000)
+	ctx := context.Background()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := limiter.Writer(ctx, nopWriteCloser{io.Discard})
+			if _, err := io.Copy(w, bytes.NewReader(make([]byte, 300_000))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 600KB at 2MB/s, less the 200KB burst.
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Fatalf("transferred 600KB in %s, want at least 200ms", elapsed)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var limiter *Limiter
+	w := nopWriteCloser{io.Discard}
+	if limiter.Writer(context.Background(), w) != w {
+		t.Error("a nil limiter wrapped the writer")
+	}
+	if err := limiter.WaitN(context.Background(), 1<<30); err != nil {
+		t.Error(err)
+	}
+}
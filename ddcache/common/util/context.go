@@ -0,0 +1,44 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ExitCodeTimeout is the exit code of a command which ran out of time, the
+// same as timeout(1) uses.
+const ExitCodeTimeout = 124
+
+// CommandContext returns the context of a command, which is cancelled on
+// SIGINT or SIGTERM, e.g. when the CI agent aborts the job, and once timeout
+// passed if it is positive.
+func CommandContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// WithTimeout is context.WithTimeout, without a deadline if timeout isn't
+// positive.
+func WithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ExitCode returns ExitCodeTimeout for failures caused by ctx running out of
+// time, and 1 for any other.
+func ExitCode(ctx context.Context) int {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ExitCodeTimeout
+	}
+	return 1
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/telemetry"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/util"
+)
+
+func deleteKeys(ctx context.Context, keys []string, cacheUrl string, params kv.NewClientParams, logger log.Logger) error {
+	logger.Infof("Deleting %d key(s) from %s", len(keys), cacheUrl)
+	store, err := storage.New(ctx, cacheUrl, params)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for _, key := range keys {
+		existed, err := store.Delete(ctx, key)
+		if err != nil {
+			return fmt.Errorf("delete %q: %w", key, err)
+		}
+		if existed {
+			fmt.Printf("Deleted %s\n", key)
+		} else {
+			fmt.Printf("Not found %s\n", key)
+		}
+	}
+	return nil
+}
+
+func main() {
+	logger := log.NewLogger()
+
+	serviceURL := flag.String("service-url", "", "Build Cache service URL: grpc[s]://host:port, http[s]://host[:port][/path], s3://bucket[/prefix], reapi[s]://host:port[/instance] or file:///path")
+	token := flag.String("access-token", "", "Access-token (prefer $DDCACHE_ACCESS_TOKEN, --access-token-file or --credential-helper, which keep it out of process listings)")
+	tokenFile := flag.String("access-token-file", "", "File containing the access-token")
+	credentialHelper := flag.String("credential-helper", "", "Shell command printing the access-token to stdout")
+	branch := flag.String("branch", "", "Branch whose archive and metadata entries should be deleted")
+	keysFlag := flag.String("keys", "", "Comma separated list of explicit keys to delete")
+	caCert := flag.String("ca-cert", "", "PEM bundle of CAs to verify the service with instead of the system roots")
+	clientCert := flag.String("client-cert", "", "PEM client certificate for mutual TLS")
+	clientKey := flag.String("client-key", "", "PEM client key for mutual TLS")
+	tlsServerName := flag.String("tls-server-name", "", "Override the server name used to verify the service certificate")
+	timeout := flag.Duration("timeout", 0, "Time budget of deleting all the keys, e.g. 1m; exits with 124 when it runs out; unlimited if 0")
+	telemetryEndpoint := flag.String("telemetry-endpoint", "", "OTLP/gRPC collector URL to export traces and metrics of the service calls to, e.g. http://localhost:4317")
+	telemetryFile := flag.String("telemetry-file", "", "File to append traces and metrics of the service calls to as JSON lines")
+
+	flag.Parse()
+
+	if *serviceURL == "" || (*branch == "" && *keysFlag == "") {
+		fmt.Println("service-url and either branch or keys are required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	tokenSource, err := kv.NewTokenSource(kv.TokenSourceParams{
+		Token:            *token,
+		TokenFile:        *tokenFile,
+		CredentialHelper: *credentialHelper,
+	})
+	if err != nil && storage.RequiresToken(*serviceURL) {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var keys []string
+	if *branch != "" {
+		keys = append(keys, fmt.Sprintf("%s-archive", *branch), fmt.Sprintf("%s-metadata", *branch))
+	}
+	for _, key := range strings.Split(*keysFlag, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	params := kv.NewClientParams{
+		TokenSource:    tokenSource,
+		CACertPath:     *caCert,
+		ClientCertPath: *clientCert,
+		ClientKeyPath:  *clientKey,
+		ServerName:     *tlsServerName,
+	}
+	tel, err := telemetry.Setup(context.Background(), telemetry.Config{
+		ServiceName: "ddcache-delete",
+		Endpoint:    *telemetryEndpoint,
+		File:        *telemetryFile,
+		Logger:      logger,
+	})
+	if err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	defer tel.Shutdown()
+
+	ctx, cancel := util.CommandContext(*timeout)
+	defer cancel()
+	if err := deleteKeys(ctx, keys, *serviceURL, params, logger); err != nil {
+		fmt.Printf("Error deleting cache entries: %v\n", err)
+		tel.Shutdown()
+		os.Exit(util.ExitCode(ctx))
+	}
+
+	fmt.Println("Cache entries deleted successfully")
+}
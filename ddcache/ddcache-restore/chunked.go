@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/chunker"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/progress"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/telemetry"
+)
+
+// downloadChunked fetches the branch's chunk manifest and reassembles the
+// archive from its chunks, taking chunks from chunkCacheDir when they are
+// already available locally. The least recently used chunks are then removed
+// from chunkCacheDir until it holds at most chunkCacheMaxSize bytes.
+func downloadChunked(ctx context.Context, store storage.Storage, downloadPath, branch, chunkCacheDir string, chunkCacheMaxSize int64, retryPolicy kv.RetryPolicy, logger log.Logger) (err error) {
+	ctx, span := telemetry.Start(ctx, "download chunked", attribute.String("ddcache.branch", branch))
+	defer func() { telemetry.End(span, err) }()
+	logger.Infof("Downloading chunked %s\n", downloadPath)
+
+	data, err := getBytesWithRetry(ctx, store, chunker.ManifestKey(branch), retryPolicy, logger)
+	if err != nil {
+		return err
+	}
+	manifest, err := chunker.UnmarshalManifest(data)
+	if err != nil {
+		return err
+	}
+
+	if chunkCacheDir != "" {
+		if err := os.MkdirAll(chunkCacheDir, 0o755); err != nil {
+			logger.Warnf("Failed to create chunk cache dir, local chunks won't be reused: %s", err)
+			chunkCacheDir = ""
+		} else {
+			defer pruneChunkCache(chunkCacheDir, chunkCacheMaxSize, logger)
+		}
+	}
+
+	file, err := os.Create(downloadPath)
+	if err != nil {
+		return fmt.Errorf("create %q: %w", downloadPath, err)
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			// Don't leave a partial archive behind, e.g. after a timeout or SIGTERM.
+			_ = os.Remove(downloadPath)
+		}
+	}()
+
+	tracker := progress.New(logger, "Downloading", downloadPath, manifest.Size)
+	hash := sha256.New()
+	w := io.MultiWriter(file, hash)
+	var reusedChunks int
+	var downloadedBytes int64
+	for _, chunk := range manifest.Chunks {
+		data, reused, err := loadChunk(ctx, store, chunk, chunkCacheDir, retryPolicy, logger)
+		if err != nil {
+			return fmt.Errorf("chunk %s: %w", chunk.Sha256, err)
+		}
+		if reused {
+			tracker.Skip(chunk.Size)
+			reusedChunks++
+		} else {
+			tracker.Add(chunk.Size)
+			downloadedBytes += chunk.Size
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("write %q: %w", downloadPath, err)
+		}
+	}
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != manifest.Sha256 {
+		_ = os.Remove(downloadPath)
+		return fmt.Errorf("checksum mismatch for %q: expected %s, got %s", downloadPath, manifest.Sha256, checksum)
+	}
+
+	logger.Infof("Reused %d of %d chunks, downloaded %s", reusedChunks, len(manifest.Chunks), humanize.Bytes(uint64(downloadedBytes)))
+	tracker.Done("Downloaded")
+	return nil
+}
+
+// loadChunk returns the chunk's data and whether it came from chunkCacheDir.
+// Downloaded chunks are added to chunkCacheDir for later restores.
+func loadChunk(ctx context.Context, store storage.Storage, chunk chunker.Chunk, chunkCacheDir string, retryPolicy kv.RetryPolicy, logger log.Logger) ([]byte, bool, error) {
+	var cachedPath string
+	if chunkCacheDir != "" {
+		cachedPath = filepath.Join(chunkCacheDir, chunk.Sha256)
+		if data, err := os.ReadFile(cachedPath); err == nil && sha256Hex(data) == chunk.Sha256 {
+			// The modification time tells pruneChunkCache when it was last used.
+			now := time.Now()
+			_ = os.Chtimes(cachedPath, now, now)
+			return data, true, nil
+		}
+	}
+
+	data, err := getBytesWithRetry(ctx, store, chunker.ChunkKey(chunk.Sha256), retryPolicy, logger)
+	if err != nil {
+		return nil, false, err
+	}
+	if checksum := sha256Hex(data); checksum != chunk.Sha256 {
+		return nil, false, fmt.Errorf("checksum mismatch: got %s", checksum)
+	}
+
+	if cachedPath != "" {
+		tmpPath := cachedPath + ".tmp"
+		err := os.WriteFile(tmpPath, data, 0o644)
+		if err == nil {
+			err = os.Rename(tmpPath, cachedPath)
+		}
+		if err != nil {
+			logger.Debugf("Failed to cache chunk %s locally: %s", chunk.Sha256, err)
+		}
+	}
+
+	return data, false, nil
+}
+
+// pruneChunkCache removes the least recently used chunks from chunkCacheDir
+// until the rest takes at most maxSize bytes.
+func pruneChunkCache(chunkCacheDir string, maxSize int64, logger log.Logger) {
+	entries, err := os.ReadDir(chunkCacheDir)
+	if err != nil {
+		logger.Debugf("Failed to list the chunk cache: %s", err)
+		return
+	}
+	var chunks []fs.FileInfo
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		chunks = append(chunks, info)
+		total += info.Size()
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].ModTime().Before(chunks[j].ModTime())
+	})
+
+	var removed int
+	for _, chunk := range chunks {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(chunkCacheDir, chunk.Name())); err != nil {
+			logger.Debugf("Failed to remove chunk %s from the chunk cache: %s", chunk.Name(), err)
+			continue
+		}
+		total -= chunk.Size()
+		removed++
+	}
+	if removed > 0 {
+		logger.Debugf("Removed %d chunks from the chunk cache, %s left", removed, humanize.Bytes(uint64(total)))
+	}
+}
+
+func getBytesWithRetry(ctx context.Context, store storage.Storage, key string, retryPolicy kv.RetryPolicy, logger log.Logger) ([]byte, error) {
+	var data []byte
+	err := retryPolicy.Do(ctx, func(attempt int) error {
+		if attempt != 0 {
+			logger.Debugf("Retrying download of %s... (attempt %d)", key, attempt+1)
+		}
+
+		kvReader, err := store.Get(ctx, kv.GetParams{Name: key})
+		if err != nil {
+			return fmt.Errorf("create kv get client: %w", err)
+		}
+		defer kvReader.Close()
+
+		data, err = io.ReadAll(kvReader)
+		if err != nil {
+			st, ok := status.FromError(err)
+			if ok && st.Code() == codes.NotFound {
+				return ErrCacheNotFound
+			}
+			return fmt.Errorf("download %s: %w", key, err)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrCacheNotFound) {
+		return nil, ErrCacheNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("with retries: %w", err)
+	}
+	return data, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
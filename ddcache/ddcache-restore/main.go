@@ -7,60 +7,198 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"time"
+	"path/filepath"
 
+	humanize "github.com/dustin/go-humanize"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/bitrise-io/go-utils/v2/log"
 	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/progress"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/telemetry"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/throttle"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/util"
 )
 
 // ErrCacheNotFound ...
 var ErrCacheNotFound = errors.New("no cache archive found for the provided keys")
 
-func download(ctx context.Context, downloadPath, key, accessToken, cacheUrl string, logger log.Logger) error {
-	logger.Infof("Downloading %s from %s\n", downloadPath, cacheUrl)
-	buildCacheHost, insecureGRPC, err := kv.ParseUrlGRPC(cacheUrl)
+func download(ctx context.Context, store storage.Storage, downloadPath, key string, concurrency int, retryPolicy kv.RetryPolicy, logger log.Logger) (err error) {
+	ctx, span := telemetry.Start(ctx, "download", attribute.String("ddcache.key", key))
+	defer func() { telemetry.End(span, err) }()
+	logger.Infof("Downloading %s\n", downloadPath)
+
+	stat, err := store.Stat(ctx, key)
+	switch {
+	case err != nil:
+		logger.Debugf("Failed to probe %s, downloading without knowing its size: %s", key, err)
+	case !stat.Exists:
+		logger.Infof("Cache miss for %s", key)
+		return ErrCacheNotFound
+	case stat.Size < 0:
+		logger.Infof("Cache hit for %s - size unknown", key)
+	default:
+		logger.Infof("Cache hit for %s - size %s", key, humanize.Bytes(uint64(stat.Size)))
+	}
+
+	// Ranges of a compressed blob can't be decompressed on their own, so it
+	// is neither fetched in parallel nor resumed, nor is a blob which failed
+	// to be probed. Blobs of unknown size are downloaded sequentially too.
+	compressed := err != nil || stat.ContentEncoding != ""
+	var size int64
+	if concurrency > 1 && stat.Size > 0 && !compressed {
+		size = stat.Size
+	}
+
+	tracker := progress.New(logger, "Downloading", key, max(stat.Size, 0))
+	expectedChecksum := stat.Sha256Sum
+	err = retryPolicy.Do(ctx, func(attempt int) error {
+		if attempt != 0 {
+			logger.Debugf("Retrying archive download... (attempt %d)", attempt+1)
+		}
+
+		var checksum string
+		var err error
+		if size > 0 {
+			checksum, err = downloadParallelAttempt(ctx, store, downloadPath, key, size, concurrency, retryPolicy, tracker, logger)
+		} else {
+			// Only resume downloads which can be verified, the partial file
+			// and the rest of the blob may belong to different saves.
+			resume := attempt != 0 && expectedChecksum != "" && !compressed
+			checksum, err = downloadAttempt(ctx, store, downloadPath, key, resume, tracker, logger)
+		}
+		if checksum != "" {
+			expectedChecksum = checksum
+		}
+		if err != nil {
+			if !errors.Is(err, ErrCacheNotFound) {
+				logger.Debugf("Failed to download archive: %s", err)
+			}
+			return err
+		}
+		return nil
+	})
+	if errors.Is(err, ErrCacheNotFound) {
+		// The probe failed or raced with a deletion, don't leave an empty file behind.
+		_ = os.Remove(downloadPath)
+		return ErrCacheNotFound
+	}
 	if err != nil {
-		return fmt.Errorf(
-			"the url grpc[s]://host:port format, %q is invalid: %w",
-			cacheUrl, err,
-		)
+		// Don't leave a partial archive behind, e.g. after a timeout or SIGTERM.
+		_ = os.Remove(downloadPath)
+		return fmt.Errorf("with retries: %w", err)
 	}
+	tracker.Done("Downloaded")
 
-	file, err := os.Create(downloadPath)
+	if expectedChecksum == "" {
+		logger.Warnf("Service did not advertise a checksum for %s, skipping verification", key)
+		return nil
+	}
+	checksum, err := util.ChecksumOfFile(downloadPath)
+	if err != nil {
+		return fmt.Errorf("checksum of %q: %w", downloadPath, err)
+	}
+	if checksum != expectedChecksum {
+		_ = os.Remove(downloadPath)
+		return fmt.Errorf("checksum mismatch for %q: expected %s, got %s", downloadPath, expectedChecksum, checksum)
+	}
+	return nil
+}
+
+// downloadAttempt streams key into downloadPath. When resume is set, the
+// download continues from the current size of a previously written partial
+// file instead of starting over. It returns the checksum advertised by the
+// service, if any, even if the download fails after the service sent it.
+func downloadAttempt(ctx context.Context, store storage.Storage, downloadPath, key string, resume bool, tracker *progress.Tracker, logger log.Logger) (string, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(downloadPath, flags, 0o666)
 	if err != nil {
-		return fmt.Errorf("create %q: %w", downloadPath, err)
+		return "", fmt.Errorf("open %q: %w", downloadPath, err)
 	}
 	defer file.Close()
 
-	kvClient, err := kv.NewClient(ctx, kv.NewClientParams{
-		UseInsecure: insecureGRPC,
-		Host:        buildCacheHost,
-		DialTimeout: 5 * time.Second,
-		ClientName:  "kv",
-		Token:       accessToken,
-	})
+	stat, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("new kv client: %w", err)
+		return "", fmt.Errorf("stat %q: %w", downloadPath, err)
+	}
+	offset := stat.Size()
+	if offset > 0 {
+		logger.Infof("Resuming download of %s from %s", key, humanize.Bytes(uint64(offset)))
 	}
 
-	kvReader, err := kvClient.Get(ctx, key)
+	kvReader, err := store.Get(ctx, kv.GetParams{
+		Name:   key,
+		Offset: offset,
+	})
+	if status.Code(err) == codes.OutOfRange {
+		// The partial file is longer than the blob, it belongs to another
+		// save: drop it so that the next attempt starts over.
+		if err := file.Truncate(0); err != nil {
+			return "", fmt.Errorf("truncate %q: %w", downloadPath, err)
+		}
+		return "", status.Errorf(codes.Aborted, "partial download doesn't match the blob: %s", err)
+	}
 	if err != nil {
-		return fmt.Errorf("create kv get client: %w", err)
+		return "", fmt.Errorf("create kv get client: %w", err)
 	}
 	defer kvReader.Close()
 
-	if _, err := io.Copy(file, kvReader); err != nil {
+	tracker.Restart(offset)
+	if _, err := io.Copy(file, tracker.Reader(kvReader)); err != nil {
 		st, ok := status.FromError(err)
 		if ok && st.Code() == codes.NotFound {
-			return ErrCacheNotFound
+			return "", ErrCacheNotFound
 		}
-		logger.Debugf("Failed to download archive: %s", err)
-		return fmt.Errorf("failed to download archive: %w", err)
+		return kvReader.Sha256Sum(), fmt.Errorf("failed to download archive: %w", err)
 	}
-	return nil
+	return kvReader.Sha256Sum(), nil
+}
+
+// downloadParallelAttempt fetches key of the given size in concurrent ranges
+// into a preallocated downloadPath. Failing ranges are retried with
+// retryPolicy on their own; the attempt only fails, starting over, once one
+// of them runs out of attempts or the blob changes meanwhile.
+func downloadParallelAttempt(ctx context.Context, store storage.Storage, downloadPath, key string, size int64, concurrency int, retryPolicy kv.RetryPolicy, tracker *progress.Tracker, logger log.Logger) (string, error) {
+	file, err := os.Create(downloadPath)
+	if err != nil {
+		return "", fmt.Errorf("create %q: %w", downloadPath, err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
+		return "", fmt.Errorf("preallocate %q: %w", downloadPath, err)
+	}
+
+	logger.Infof("Downloading %s - size %s in %d ranges", key, humanize.Bytes(uint64(size)), concurrency)
+	tracker.Restart(0)
+	checksum, err := kv.GetParallel(ctx, store, tracker.WriterAt(file), kv.GetParallelParams{
+		Name:        key,
+		Size:        size,
+		Concurrency: concurrency,
+		RetryPolicy: retryPolicy,
+	})
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok && st.Code() == codes.NotFound {
+			return "", ErrCacheNotFound
+		}
+		return "", fmt.Errorf("failed to download archive: %w", err)
+	}
+	return checksum, nil
+}
+
+func defaultChunkCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ddcache", "chunks")
 }
 
 func main() {
@@ -68,32 +206,121 @@ func main() {
 
 	cacheArchiveDownloadPath := flag.String("cache-archive", "", "Download path for the cache archive")
 	cacheMetadataDownloadPath := flag.String("cache-metadata", "", "Download path for the cache metadata")
-	serviceURL := flag.String("service-url", "", "Build Cache service URL")
-	token := flag.String("access-token", "", "Access-token")
+	serviceURL := flag.String("service-url", "", "Build Cache service URL: grpc[s]://host:port, http[s]://host[:port][/path], s3://bucket[/prefix], reapi[s]://host:port[/instance] or file:///path")
+	token := flag.String("access-token", "", "Access-token (prefer $DDCACHE_ACCESS_TOKEN, --access-token-file or --credential-helper, which keep it out of process listings)")
+	tokenFile := flag.String("access-token-file", "", "File containing the access-token")
+	credentialHelper := flag.String("credential-helper", "", "Shell command printing the access-token to stdout")
 	branch := flag.String("branch", "", "Branch")
+	concurrency := flag.Int("concurrency", 1, "Number of ranges to download in parallel")
+	retryAttempts := flag.Int("retry-attempts", kv.DefaultRetryPolicy.MaxAttempts, "Number of attempts for transient failures")
+	retryMaxWait := flag.Duration("retry-max-wait", kv.DefaultRetryPolicy.MaxWait, "Maximum wait between two attempts")
+	caCert := flag.String("ca-cert", "", "PEM bundle of CAs to verify the service with instead of the system roots")
+	clientCert := flag.String("client-cert", "", "PEM client certificate for mutual TLS")
+	clientKey := flag.String("client-key", "", "PEM client key for mutual TLS")
+	tlsServerName := flag.String("tls-server-name", "", "Override the server name used to verify the service certificate")
+	chunked := flag.Bool("chunked", false, "Restore a cache archive saved as content-defined chunks")
+	chunkCacheDir := flag.String("chunk-cache-dir", defaultChunkCacheDir(), "Directory of locally cached chunks reused by chunked restores, empty disables it")
+	chunkCacheMaxSize := flag.String("chunk-cache-max-size", "10GB", "Size the chunk cache is trimmed to after chunked restores, removing the least recently used chunks")
+	timeout := flag.Duration("timeout", 0, "Time budget of the whole restore, e.g. 10m; exits with 124 when it runs out; unlimited if 0")
+	keyTimeout := flag.Duration("key-timeout", 0, "Time budget of downloading each of the archive and the metadata; unlimited if 0")
+	maxDownloadRate := flag.String("max-download-rate", "", "Bandwidth limit of all downloads together, e.g. 20MB or 50MiB per second; unlimited if empty")
+	telemetryEndpoint := flag.String("telemetry-endpoint", "", "OTLP/gRPC collector URL to export traces and metrics of the service calls to, e.g. http://localhost:4317")
+	telemetryFile := flag.String("telemetry-file", "", "File to append traces and metrics of the service calls to as JSON lines")
 
 	flag.Parse()
 
 	cacheArchiveKey := fmt.Sprintf("%s-archive", *branch)
 	cacheMetadataKey := fmt.Sprintf("%s-metadata", *branch)
 
-	if *cacheArchiveDownloadPath == "" || *cacheMetadataDownloadPath == "" || *serviceURL == "" || *token == "" || *branch == "" {
-		fmt.Println("cache-archive, cache-metadata, access-token, branch and service-url are required")
+	if *cacheArchiveDownloadPath == "" || *cacheMetadataDownloadPath == "" || *serviceURL == "" || *branch == "" {
+		fmt.Println("cache-archive, cache-metadata, branch and service-url are required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	err := download(context.Background(), *cacheArchiveDownloadPath, cacheArchiveKey, *token, *serviceURL, logger)
+	tokenSource, err := kv.NewTokenSource(kv.TokenSourceParams{
+		Token:            *token,
+		TokenFile:        *tokenFile,
+		CredentialHelper: *credentialHelper,
+	})
+	if err != nil && storage.RequiresToken(*serviceURL) {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	downloadRate, err := throttle.ParseRate(*maxDownloadRate)
 	if err != nil {
-		fmt.Printf("Error downloading cache archive: %v\n", err)
+		fmt.Println(err)
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	err = download(context.Background(), *cacheMetadataDownloadPath, cacheMetadataKey, *token, *serviceURL, logger)
+	chunkCacheLimit, err := humanize.ParseBytes(*chunkCacheMaxSize)
 	if err != nil {
-		fmt.Printf("Error downloading cache metadata: %v\n", err)
+		fmt.Printf("invalid chunk cache size %q: %s\n", *chunkCacheMaxSize, err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	retryPolicy := kv.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = *retryAttempts
+	retryPolicy.MaxWait = *retryMaxWait
+
+	tel, err := telemetry.Setup(context.Background(), telemetry.Config{
+		ServiceName: "ddcache-restore",
+		Endpoint:    *telemetryEndpoint,
+		File:        *telemetryFile,
+		Logger:      logger,
+	})
+	if err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	defer tel.Shutdown()
+
+	ctx, cancel := util.CommandContext(*timeout)
+	defer cancel()
+	logger.Infof("Connecting to %s", *serviceURL)
+	store, err := storage.New(ctx, *serviceURL, kv.NewClientParams{
+		TokenSource:    tokenSource,
+		CACertPath:     *caCert,
+		ClientCertPath: *clientCert,
+		ClientKeyPath:  *clientKey,
+		ServerName:     *tlsServerName,
+	})
+	if err != nil {
+		fmt.Printf("Error connecting to cache service: %v\n", err)
+		tel.Shutdown()
 		os.Exit(1)
 	}
+	defer store.Close()
+	store = storage.Throttle(store, nil, throttle.NewLimiter(downloadRate))
+
+	archiveCtx, cancelArchive := util.WithTimeout(ctx, *keyTimeout)
+	defer cancelArchive()
+	if *chunked {
+		err = downloadChunked(archiveCtx, store, *cacheArchiveDownloadPath, *branch, *chunkCacheDir, int64(chunkCacheLimit), retryPolicy, logger)
+	} else {
+		err = download(archiveCtx, store, *cacheArchiveDownloadPath, cacheArchiveKey, *concurrency, retryPolicy, logger)
+	}
+	if err != nil {
+		fmt.Printf("Error downloading cache archive: %v\n", err)
+		store.Close()
+		tel.Shutdown()
+		os.Exit(util.ExitCode(archiveCtx))
+	}
+
+	metadataCtx, cancelMetadata := util.WithTimeout(ctx, *keyTimeout)
+	defer cancelMetadata()
+	err = download(metadataCtx, store, *cacheMetadataDownloadPath, cacheMetadataKey, *concurrency, retryPolicy, logger)
+	if err != nil {
+		fmt.Printf("Error downloading cache metadata: %v\n", err)
+		store.Close()
+		tel.Shutdown()
+		os.Exit(util.ExitCode(metadataCtx))
+	}
 
 	fmt.Println("Files downloaded successfully")
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/chunker"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/progress"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/util"
+)
+
+var testRetryPolicy = kv.RetryPolicy{MaxAttempts: 3, BaseWait: time.Millisecond, MaxWait: 10 * time.Millisecond}
+
+func assertFileContent(t *testing.T, path string, want []byte) {
+	t.Helper()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s has %d bytes, want %d matching bytes", path, len(got), len(want))
+	}
+}
+
+func TestDownload(t *testing.T) {
+	server := kvtest.NewServer(t, kvtest.WithToken("token"))
+	client := server.NewClient(t)
+	data := kvtest.RandomData(300 * 1024)
+	server.SetBlob("kv/main-archive", data)
+	path := filepath.Join(t.TempDir(), "archive")
+
+	if err := download(context.Background(), client, path, "main-archive", 1, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	assertFileContent(t, path, data)
+}
+
+func TestDownloadWhenWriteStatusForgetsBlobs(t *testing.T) {
+	server := kvtest.NewServer(t, kvtest.WithUploadsOnlyWriteStatus())
+	client := server.NewClient(t)
+	data := kvtest.RandomData(300 * 1024)
+	server.SetBlob("kv/main-archive", data)
+	path := filepath.Join(t.TempDir(), "archive")
+
+	if err := download(context.Background(), client, path, "main-archive", 4, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	assertFileContent(t, path, data)
+}
+
+func TestDownloadMissLeavesNoFile(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	path := filepath.Join(t.TempDir(), "archive")
+
+	err := download(context.Background(), client, path, "main-archive", 1, testRetryPolicy, log.NewLogger())
+	if !errors.Is(err, ErrCacheNotFound) {
+		t.Fatalf("got %v, want ErrCacheNotFound", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("download left %s behind", path)
+	}
+}
+
+func TestDownloadResumesAfterDisconnect(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	data := kvtest.RandomData(1024 * 1024)
+	server.SetBlob("kv/main-archive", data)
+	server.DisconnectAfter(300*1024, 2)
+	path := filepath.Join(t.TempDir(), "archive")
+
+	if err := download(context.Background(), client, path, "main-archive", 1, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	assertFileContent(t, path, data)
+}
+
+func TestDownloadWithoutChecksumStartsOver(t *testing.T) {
+	data := kvtest.RandomData(1024 * 1024)
+	var gets, ranges atomic.Int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No checksum header, like the hosted service.
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		if gets.Add(1) == 1 {
+			// Break the connection halfway through.
+			w.Write(data[:len(data)/2])
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(httpServer.Close)
+	store, err := storage.New(context.Background(), httpServer.URL, kv.NewClientParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "archive")
+
+	if err := download(context.Background(), store, path, "main-archive", 1, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	assertFileContent(t, path, data)
+	if n := ranges.Load(); n != 0 {
+		t.Errorf("resumed %d times a download which can't be verified", n)
+	}
+}
+
+func TestDownloadAttemptStartsOverPastEnd(t *testing.T) {
+	data := kvtest.RandomData(1024)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "main-archive", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(httpServer.Close)
+	store, err := storage.New(context.Background(), httpServer.URL, kv.NewClientParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A partial download of a larger blob, replaced by a smaller one since.
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(path, kvtest.RandomData(2048), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := progress.New(log.NewLogger(), "Downloading", "main-archive", int64(len(data)))
+	if _, err := downloadAttempt(context.Background(), store, path, "main-archive", true, tracker, log.NewLogger()); !kv.IsRetryable(err) {
+		t.Fatalf("resuming past the end: %v, want a retryable error", err)
+	}
+	if _, err := downloadAttempt(context.Background(), store, path, "main-archive", true, tracker, log.NewLogger()); err != nil {
+		t.Fatalf("download after starting over: %s", err)
+	}
+	assertFileContent(t, path, data)
+}
+
+func TestDownloadTimeoutRemovesPartialFile(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	server.SetBlob("kv/main-archive", kvtest.RandomData(1024*1024))
+	server.SetLatency(20 * time.Millisecond)
+	path := filepath.Join(t.TempDir(), "archive")
+
+	ctx, cancel := util.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := download(ctx, client, path, "main-archive", 1, testRetryPolicy, log.NewLogger()); err == nil {
+		t.Fatal("download succeeded despite the timeout")
+	}
+	if code := util.ExitCode(ctx); code != util.ExitCodeTimeout {
+		t.Errorf("exit code %d, want %d", code, util.ExitCodeTimeout)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("download left partial %s behind", path)
+	}
+}
+
+func TestDownloadParallel(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	data := kvtest.RandomData(1024*1024 + 17)
+	server.SetBlob("kv/main-archive", data)
+	path := filepath.Join(t.TempDir(), "archive")
+
+	if err := download(context.Background(), client, path, "main-archive", 4, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	assertFileContent(t, path, data)
+}
+
+func TestDownloadParallelOfUnknownSize(t *testing.T) {
+	data := kvtest.RandomData(1024*1024 + 17)
+	var ranges atomic.Int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// No Content-Length, like servers compressing on the fly.
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(httpServer.Close)
+	store, err := storage.New(context.Background(), httpServer.URL, kv.NewClientParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "archive")
+
+	if err := download(context.Background(), store, path, "main-archive", 4, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	assertFileContent(t, path, data)
+	if n := ranges.Load(); n != 0 {
+		t.Errorf("requested %d ranges of a blob of unknown size", n)
+	}
+}
+
+func TestDownloadCompressed(t *testing.T) {
+	server := kvtest.NewServer(t)
+	uploader := server.NewClient(t, func(p *kv.NewClientParams) { p.CompressionLevel = zstd.SpeedFastest })
+	data := bytes.Repeat(kvtest.RandomData(1000), 2000)
+	if err := kvtest.Put(context.Background(), uploader, "main-archive", data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "archive")
+
+	// The ranges of a parallel download can't be decompressed, it falls back to a single stream.
+	if err := download(context.Background(), server.NewClient(t), path, "main-archive", 4, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download: %s", err)
+	}
+	assertFileContent(t, path, data)
+}
+
+func TestDownloadCorruptedFailsVerification(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	server.SetBlob("kv/main-archive", kvtest.RandomData(100*1024))
+	server.SetCorrupt(true)
+	path := filepath.Join(t.TempDir(), "archive")
+
+	if err := download(context.Background(), client, path, "main-archive", 1, testRetryPolicy, log.NewLogger()); err == nil {
+		t.Fatal("download of corrupted data succeeded")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("download left corrupted %s behind", path)
+	}
+}
+
+func TestDownloadChunkedReusesLocalChunks(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	data := kvtest.RandomData(6 * 1024 * 1024)
+	manifest, err := chunker.BuildManifest(bytes.NewReader(data), chunker.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range manifest.Chunks {
+		server.SetBlob("kv/"+chunker.ChunkKey(chunk.Sha256), data[chunk.Offset:chunk.Offset+chunk.Size])
+	}
+	manifestData, err := manifest.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetBlob("kv/"+chunker.ManifestKey("main"), manifestData)
+
+	ctx := context.Background()
+	chunkCacheDir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := downloadChunked(ctx, client, path, "main", chunkCacheDir, 1<<40, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download chunked: %s", err)
+	}
+	assertFileContent(t, path, data)
+
+	// Every chunk is cached locally now, the service isn't needed anymore.
+	for _, chunk := range manifest.Chunks {
+		server.SetBlob("kv/"+chunker.ChunkKey(chunk.Sha256), nil)
+	}
+	path = filepath.Join(t.TempDir(), "archive")
+	if err := downloadChunked(ctx, client, path, "main", chunkCacheDir, 1<<40, testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("download chunked from local chunks: %s", err)
+	}
+	assertFileContent(t, path, data)
+}
+
+func TestPruneChunkCacheRemovesLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"used-last", "used-first", "used-second"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		used := now.Add(time.Duration(i) * time.Minute)
+		if name == "used-last" {
+			used = now.Add(time.Hour)
+		}
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneChunkCache(dir, 250, log.NewLogger())
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 || names[0] != "used-last" || names[1] != "used-second" {
+		t.Fatalf("chunk cache holds %v, want used-last and used-second", names)
+	}
+}
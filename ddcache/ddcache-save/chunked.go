@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/chunker"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/progress"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/telemetry"
+)
+
+// uploadChunked splits the archive into content-defined chunks, uploads the
+// chunks the service does not have yet and then the branch's chunk manifest.
+func uploadChunked(ctx context.Context, store storage.Storage, filePath, branch string, retryPolicy kv.RetryPolicy, logger log.Logger) (err error) {
+	ctx, span := telemetry.Start(ctx, "upload chunked", attribute.String("ddcache.branch", branch))
+	defer func() { telemetry.End(span, err) }()
+	fmt.Printf("Initializing chunked uploading %s\n", filePath)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open %q: %w", filePath, err)
+	}
+	defer file.Close()
+
+	manifest, err := chunker.BuildManifest(file, chunker.DefaultParams)
+	if err != nil {
+		return fmt.Errorf("chunk %q: %w", filePath, err)
+	}
+	fmt.Printf("Split %s - size %s into %d chunks\n", filePath, humanize.Bytes(uint64(manifest.Size)), len(manifest.Chunks))
+
+	tracker := progress.New(logger, "Uploading", filePath, manifest.Size)
+	exists := existingChunks(ctx, store, manifest.Chunks)
+	var uploadedChunks int
+	var uploadedBytes int64
+	for i, chunk := range manifest.Chunks {
+		key := chunker.ChunkKey(chunk.Sha256)
+		if exists[i] {
+			tracker.Skip(chunk.Size)
+			continue
+		}
+
+		section := io.NewSectionReader(file, chunk.Offset, chunk.Size)
+		if err := putWithRetry(ctx, store, key, chunk.Sha256, section, chunk.Size, retryPolicy, logger); err != nil {
+			return fmt.Errorf("upload chunk %s: %w", chunk.Sha256, err)
+		}
+		tracker.Add(chunk.Size)
+		uploadedChunks++
+		uploadedBytes += chunk.Size
+	}
+	fmt.Printf("Uploaded %d of %d chunks - size %s\n", uploadedChunks, len(manifest.Chunks), humanize.Bytes(uint64(uploadedBytes)))
+	tracker.Done("Uploaded")
+
+	data, err := manifest.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	manifestReader := bytes.NewReader(data)
+	if err := putWithRetry(ctx, store, chunker.ManifestKey(branch), hex.EncodeToString(sum[:]), manifestReader, int64(len(data)), retryPolicy, logger); err != nil {
+		return fmt.Errorf("upload manifest: %w", err)
+	}
+
+	return nil
+}
+
+// statConcurrency is the number of chunks whose existence is checked at the
+// same time, so that archives of thousands of chunks don't wait for as many
+// round trips one after the other.
+const statConcurrency = 16
+
+// existingChunks reports which of chunks the service already stores.
+func existingChunks(ctx context.Context, store storage.Storage, chunks []chunker.Chunk) []bool {
+	exists := make([]bool, len(chunks))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(statConcurrency, len(chunks)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				exists[i] = chunkExists(ctx, store, chunker.ChunkKey(chunks[i].Sha256), chunks[i].Size)
+			}
+		}()
+	}
+	for i := range chunks {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return exists
+}
+
+// chunkExists reports whether the service already stores a complete chunk
+// under key. Any failure to tell is treated as a missing chunk.
+func chunkExists(ctx context.Context, store storage.Storage, key string, size int64) bool {
+	stat, err := store.Stat(ctx, key)
+	if err != nil || !stat.Exists {
+		return false
+	}
+	if stat.Size < 0 {
+		// Chunks are content addressed, a stored chunk is the same chunk.
+		return true
+	}
+	return stat.Size == size
+}
+
+func putWithRetry(ctx context.Context, store storage.Storage, key, checksum string, r io.ReadSeeker, size int64, retryPolicy kv.RetryPolicy, logger log.Logger) error {
+	return retryPolicy.Do(ctx, func(attempt int) error {
+		if attempt != 0 {
+			logger.Debugf("Retrying upload of %s... (attempt %d)", key, attempt+1)
+			if _, err := r.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("rewind: %w", err)
+			}
+		}
+
+		kvWriter, err := store.Put(ctx, kv.PutParams{
+			Name:      key,
+			Sha256Sum: checksum,
+			FileSize:  size,
+		})
+		if err != nil {
+			return fmt.Errorf("create kv put client: %w", err)
+		}
+		if _, err := io.Copy(kvWriter, r); err != nil {
+			_ = kvWriter.Abort()
+			return fmt.Errorf("upload: %w", err)
+		}
+		if err := kvWriter.Close(); err != nil {
+			return fmt.Errorf("close upload: %w", err)
+		}
+		return nil
+	})
+}
@@ -6,25 +6,25 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"time"
 
 	humanize "github.com/dustin/go-humanize"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
-	"github.com/bitrise-io/go-utils/retry"
 	"github.com/bitrise-io/go-utils/v2/log"
 	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/progress"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/storage"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/telemetry"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/throttle"
 	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/util"
 )
 
-func upload(filePath, key, accessToken, cacheUrl string, logger log.Logger) error {
-	fmt.Printf("Initializing uploading %s to %s\n", filePath, cacheUrl)
-	buildCacheHost, insecureGRPC, err := kv.ParseUrlGRPC(cacheUrl)
-	if err != nil {
-		return fmt.Errorf(
-			"the url grpc[s]://host:port format, %q is invalid: %w",
-			cacheUrl, err,
-		)
-	}
+func upload(ctx context.Context, store storage.Storage, filePath, key string, retryPolicy kv.RetryPolicy, logger log.Logger) (err error) {
+	ctx, span := telemetry.Start(ctx, "upload", attribute.String("ddcache.key", key))
+	defer func() { telemetry.End(span, err) }()
+	fmt.Printf("Initializing uploading %s\n", filePath)
 
 	checksum, err := util.ChecksumOfFile(filePath)
 	if err != nil {
@@ -32,85 +32,228 @@ func upload(filePath, key, accessToken, cacheUrl string, logger log.Logger) erro
 		// fail silently and continue
 	}
 
-	const retries = 3
-	err = retry.Times(retries).Wait(5 * time.Second).TryWithAbort(func(attempt uint) (error, bool) {
+	var tracker *progress.Tracker
+	err = retryPolicy.Do(ctx, func(attempt int) error {
 		if attempt != 0 {
 			logger.Debugf("Retrying archive upload... (attempt %d)", attempt+1)
 		}
 
-		ctx := context.Background()
-		kvClient, err := kv.NewClient(ctx, kv.NewClientParams{
-			UseInsecure: insecureGRPC,
-			Host:        buildCacheHost,
-			DialTimeout: 5 * time.Second,
-			ClientName:  "kv",
-			Token:       accessToken,
-		})
-		if err != nil {
-			return fmt.Errorf("new kv client: %w", err), false
-		}
-
 		file, err := os.Open(filePath)
 		if err != nil {
-			return fmt.Errorf("open %q: %w", filePath, err), false
+			return fmt.Errorf("open %q: %w", filePath, err)
 		}
 		defer file.Close()
 		stat, err := file.Stat()
 		if err != nil {
-			return fmt.Errorf("stat %q: %w", filePath, err), false
+			return fmt.Errorf("stat %q: %w", filePath, err)
 		}
-
-		fmt.Printf("Uploading %s - size %s\n", filePath, humanize.Bytes(uint64(stat.Size())))
-
-		kvWriter, err := kvClient.Put(ctx, kv.PutParams{
-			Name:      key,
-			Sha256Sum: checksum,
-			FileSize:  stat.Size(),
-		})
-		if err != nil {
-			return fmt.Errorf("create kv put client: %w", err), false
+		if tracker == nil {
+			tracker = progress.New(logger, "Uploading", key, stat.Size())
 		}
-		if _, err := io.Copy(kvWriter, file); err != nil {
-			return fmt.Errorf("upload archive: %w", err), false
+
+		var offset int64
+		if attempt != 0 {
+			offset = resumeOffset(ctx, store, key, stat.Size(), logger)
 		}
-		if err := kvWriter.Close(); err != nil {
-			return fmt.Errorf("close upload: %w", err), false
+		err = uploadAttempt(ctx, store, file, key, checksum, stat.Size(), offset, tracker)
+		if offset > 0 && isRejectedResume(err) {
+			// The committed prefix may belong to another upload of the key,
+			// e.g. a previous build's or a concurrent job's.
+			logger.Warnf("Failed to resume the upload of %s, starting over: %s", filePath, err)
+			err = uploadAttempt(ctx, store, file, key, checksum, stat.Size(), 0, tracker)
 		}
-		return nil, false
+		return err
 	})
 	if err != nil {
 		return fmt.Errorf("with retries: %w", err)
 	}
 
+	tracker.Done("Uploaded")
+	return nil
+}
+
+// uploadAttempt uploads file from offset, where the service has committed an
+// interrupted upload of it.
+func uploadAttempt(ctx context.Context, store storage.Storage, file *os.File, key, checksum string, size, offset int64, tracker *progress.Tracker) error {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek %q: %w", file.Name(), err)
+	}
+	if offset > 0 {
+		fmt.Printf("Resuming upload of %s from %s - size %s\n", file.Name(), humanize.Bytes(uint64(offset)), humanize.Bytes(uint64(size)))
+	} else {
+		fmt.Printf("Uploading %s - size %s\n", file.Name(), humanize.Bytes(uint64(size)))
+	}
+
+	kvWriter, err := store.Put(ctx, kv.PutParams{
+		Name:      key,
+		Sha256Sum: checksum,
+		FileSize:  size,
+		Offset:    offset,
+	})
+	if err != nil {
+		return fmt.Errorf("create kv put client: %w", err)
+	}
+	tracker.Restart(offset)
+	w := tracker.Writer(kvWriter)
+	if _, err := io.Copy(w, file); err != nil {
+		_ = kvWriter.Abort()
+		return fmt.Errorf("upload archive: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("close upload: %w", err)
+	}
 	return nil
 }
 
+// isRejectedResume reports whether the service rejected a resumed upload,
+// e.g. because the checksum of the whole blob didn't match.
+func isRejectedResume(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		return true
+	default:
+		return false
+	}
+}
+
+// resumeOffset asks the service how much of an interrupted upload of key it has
+// already committed. It returns 0 (upload from the beginning) whenever the
+// status is unknown or does not belong to an unfinished write of this file:
+// a complete entry may be the previous build's blob stored under the same key.
+// Backends which don't keep interrupted uploads always start over.
+func resumeOffset(ctx context.Context, store storage.Storage, key string, fileSize int64, logger log.Logger) int64 {
+	resumable, ok := store.(storage.Resumable)
+	if !ok {
+		return 0
+	}
+	ws, err := resumable.QueryWriteStatus(ctx, key)
+	if err != nil {
+		logger.Debugf("Failed to query upload status, starting over: %s", err)
+		return 0
+	}
+	if ws.Complete || ws.CommittedSize < 0 || ws.CommittedSize > fileSize {
+		return 0
+	}
+	return ws.CommittedSize
+}
+
 func main() {
 	logger := log.NewLogger()
 
 	cacheArchive := flag.String("cache-archive", "", "Path to the cache archive file to upload")
 	cacheMetadata := flag.String("cache-metadata", "", "Path to the metadata file to upload")
-	uploadURL := flag.String("upload-url", "", "URL to upload the files to")
-	accessToken := flag.String("access-token", "", "Access-token")
+	uploadURL := flag.String("upload-url", "", "URL to upload the files to: grpc[s]://host:port, http[s]://host[:port][/path], s3://bucket[/prefix], reapi[s]://host:port[/instance] or file:///path")
+	accessToken := flag.String("access-token", "", "Access-token (prefer $DDCACHE_ACCESS_TOKEN, --access-token-file or --credential-helper, which keep it out of process listings)")
+	tokenFile := flag.String("access-token-file", "", "File containing the access-token")
+	credentialHelper := flag.String("credential-helper", "", "Shell command printing the access-token to stdout")
 	branch := flag.String("branch", "", "Branch")
+	retryAttempts := flag.Int("retry-attempts", kv.DefaultRetryPolicy.MaxAttempts, "Number of attempts for transient failures")
+	retryMaxWait := flag.Duration("retry-max-wait", kv.DefaultRetryPolicy.MaxWait, "Maximum wait between two attempts")
+	caCert := flag.String("ca-cert", "", "PEM bundle of CAs to verify the service with instead of the system roots")
+	clientCert := flag.String("client-cert", "", "PEM client certificate for mutual TLS")
+	clientKey := flag.String("client-key", "", "PEM client key for mutual TLS")
+	tlsServerName := flag.String("tls-server-name", "", "Override the server name used to verify the service certificate")
+	chunked := flag.Bool("chunked", false, "Upload the cache archive as content-defined chunks, skipping chunks the service already has")
+	timeout := flag.Duration("timeout", 0, "Time budget of the whole save, e.g. 10m; exits with 124 when it runs out; unlimited if 0")
+	keyTimeout := flag.Duration("key-timeout", 0, "Time budget of uploading each of the archive and the metadata; unlimited if 0")
+	maxUploadRate := flag.String("max-upload-rate", "", "Bandwidth limit of all uploads together, e.g. 20MB or 50MiB per second; unlimited if empty")
+	compressionLevel := flag.String("compression-level", "none", "Compress uploads with zstd, unless incompressible: none, fastest, default, better or best (grpc[s] only)")
+	telemetryEndpoint := flag.String("telemetry-endpoint", "", "OTLP/gRPC collector URL to export traces and metrics of the service calls to, e.g. http://localhost:4317")
+	telemetryFile := flag.String("telemetry-file", "", "File to append traces and metrics of the service calls to as JSON lines")
 
 	flag.Parse()
 
-	if *cacheArchive == "" || *cacheMetadata == "" || *uploadURL == "" || *accessToken == "" || *branch == "" {
-		fmt.Println("cache-archive, cache-metadata, token, branch and upload-url are required")
+	if *cacheArchive == "" || *cacheMetadata == "" || *uploadURL == "" || *branch == "" {
+		fmt.Println("cache-archive, cache-metadata, branch and upload-url are required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if err := upload(*cacheArchive, fmt.Sprintf("%s-archive", *branch), *accessToken, *uploadURL, logger); err != nil {
-		fmt.Printf("Error uploading cache archive: %v\n", err)
+	tokenSource, err := kv.NewTokenSource(kv.TokenSourceParams{
+		Token:            *accessToken,
+		TokenFile:        *tokenFile,
+		CredentialHelper: *credentialHelper,
+	})
+	if err != nil && storage.RequiresToken(*uploadURL) {
+		fmt.Println(err)
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	if err := upload(*cacheMetadata, fmt.Sprintf("%s-metadata", *branch), *accessToken, *uploadURL, logger); err != nil {
-		fmt.Printf("Error uploading metadata: %v\n", err)
+	compression, err := kv.ParseCompressionLevel(*compressionLevel)
+	if err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	uploadRate, err := throttle.ParseRate(*maxUploadRate)
+	if err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	retryPolicy := kv.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = *retryAttempts
+	retryPolicy.MaxWait = *retryMaxWait
+
+	tel, err := telemetry.Setup(context.Background(), telemetry.Config{
+		ServiceName: "ddcache-save",
+		Endpoint:    *telemetryEndpoint,
+		File:        *telemetryFile,
+		Logger:      logger,
+	})
+	if err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	defer tel.Shutdown()
+
+	ctx, cancel := util.CommandContext(*timeout)
+	defer cancel()
+	fmt.Printf("Connecting to %s\n", *uploadURL)
+	store, err := storage.New(ctx, *uploadURL, kv.NewClientParams{
+		TokenSource:      tokenSource,
+		CACertPath:       *caCert,
+		ClientCertPath:   *clientCert,
+		ClientKeyPath:    *clientKey,
+		ServerName:       *tlsServerName,
+		CompressionLevel: compression,
+	})
+	if err != nil {
+		fmt.Printf("Error connecting to cache service: %v\n", err)
+		tel.Shutdown()
 		os.Exit(1)
 	}
+	defer store.Close()
+	store = storage.Throttle(store, throttle.NewLimiter(uploadRate), nil)
+
+	archiveCtx, cancelArchive := util.WithTimeout(ctx, *keyTimeout)
+	defer cancelArchive()
+	if *chunked {
+		if err := uploadChunked(archiveCtx, store, *cacheArchive, *branch, retryPolicy, logger); err != nil {
+			fmt.Printf("Error uploading chunked cache archive: %v\n", err)
+			store.Close()
+			tel.Shutdown()
+			os.Exit(util.ExitCode(archiveCtx))
+		}
+	} else if err := upload(archiveCtx, store, *cacheArchive, fmt.Sprintf("%s-archive", *branch), retryPolicy, logger); err != nil {
+		fmt.Printf("Error uploading cache archive: %v\n", err)
+		store.Close()
+		tel.Shutdown()
+		os.Exit(util.ExitCode(archiveCtx))
+	}
+
+	metadataCtx, cancelMetadata := util.WithTimeout(ctx, *keyTimeout)
+	defer cancelMetadata()
+	if err := upload(metadataCtx, store, *cacheMetadata, fmt.Sprintf("%s-metadata", *branch), retryPolicy, logger); err != nil {
+		fmt.Printf("Error uploading metadata: %v\n", err)
+		store.Close()
+		tel.Shutdown()
+		os.Exit(util.ExitCode(metadataCtx))
+	}
 
 	fmt.Println("Files uploaded successfully")
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/chunker"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kv"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvtest"
+)
+
+var testRetryPolicy = kv.RetryPolicy{MaxAttempts: 3, BaseWait: time.Millisecond, MaxWait: 10 * time.Millisecond}
+
+func writeRandomFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+
+	data := kvtest.RandomData(size)
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestUpload(t *testing.T) {
+	server := kvtest.NewServer(t, kvtest.WithToken("token"))
+	client := server.NewClient(t)
+	path, data := writeRandomFile(t, 300*1024)
+
+	if err := upload(context.Background(), client, path, "main-archive", testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+
+	if got, _ := server.Blob("kv/main-archive"); !bytes.Equal(got, data) {
+		t.Fatalf("stored %d bytes, want %d matching bytes", len(got), len(data))
+	}
+}
+
+func TestUploadResumesAfterDisconnect(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	path, data := writeRandomFile(t, 1024*1024)
+	server.DisconnectAfter(400*1024, 1)
+
+	if err := upload(context.Background(), client, path, "main-archive", testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+
+	if got, _ := server.Blob("kv/main-archive"); !bytes.Equal(got, data) {
+		t.Fatalf("stored %d bytes, want %d matching bytes", len(got), len(data))
+	}
+}
+
+func TestUploadStartsOverAfterForeignPartialUpload(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	path, data := writeRandomFile(t, 500*1024)
+	// Another job's interrupted upload of the key.
+	server.SetPending("kv/main-archive", kvtest.RandomData(200*1024))
+	server.FailNext(codes.Unavailable, 1)
+
+	if err := upload(context.Background(), client, path, "main-archive", testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	if got, _ := server.Blob("kv/main-archive"); !bytes.Equal(got, data) {
+		t.Fatalf("stored %d bytes, want %d matching bytes", len(got), len(data))
+	}
+}
+
+func TestUploadDoesNotRetryPermissionDenied(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	path, _ := writeRandomFile(t, 1024)
+	server.FailNext(codes.PermissionDenied, 1)
+
+	if err := upload(context.Background(), client, path, "main-archive", testRetryPolicy, log.NewLogger()); err == nil {
+		t.Fatal("upload succeeded, want PermissionDenied")
+	}
+	if _, ok := server.Blob("kv/main-archive"); ok {
+		t.Fatal("upload was retried after PermissionDenied")
+	}
+}
+
+func TestUploadChunkedSkipsExistingChunks(t *testing.T) {
+	server := kvtest.NewServer(t)
+	client := server.NewClient(t)
+	path, data := writeRandomFile(t, 6*1024*1024)
+	ctx := context.Background()
+
+	if err := uploadChunked(ctx, client, path, "main", testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("upload chunked: %s", err)
+	}
+	firstPuts := server.Puts()
+
+	// Same content under another branch: only the manifest is new.
+	if err := uploadChunked(ctx, client, path, "feature", testRetryPolicy, log.NewLogger()); err != nil {
+		t.Fatalf("upload chunked: %s", err)
+	}
+	if got := server.Puts() - firstPuts; got != 1 {
+		t.Errorf("second upload made %d puts, want 1 (the manifest)", got)
+	}
+
+	manifestData, ok := server.Blob("kv/" + chunker.ManifestKey("feature"))
+	if !ok {
+		t.Fatal("manifest not stored")
+	}
+	manifest, err := chunker.UnmarshalManifest(manifestData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reassembled []byte
+	for _, chunk := range manifest.Chunks {
+		chunkData, ok := server.Blob("kv/" + chunker.ChunkKey(chunk.Sha256))
+		if !ok {
+			t.Fatalf("chunk %s not stored", chunk.Sha256)
+		}
+		reassembled = append(reassembled, chunkData...)
+	}
+	if !bytes.Equal(reassembled, data) {
+		t.Fatal("chunks don't reassemble to the archive")
+	}
+}
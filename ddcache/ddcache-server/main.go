@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	humanize "github.com/dustin/go-humanize"
+	"google.golang.org/grpc"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/xcodebuild-cache-tools/ddcache/common/kvserver"
+)
+
+func main() {
+	logger := log.NewLogger()
+
+	listenAddr := flag.String("listen", ":6666", "Address to serve the KVStorage service on")
+	dataDir := flag.String("data-dir", "", "Directory to store cache entries in")
+	configPath := flag.String("config", "", "JSON config file with the accepted bearer tokens")
+
+	flag.Parse()
+
+	if *dataDir == "" {
+		fmt.Println("data-dir is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var config kvserver.Config
+	if *configPath != "" {
+		var err error
+		config, err = kvserver.LoadConfig(*configPath)
+		if err != nil {
+			fmt.Printf("Error loading config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if len(config.Tokens) == 0 {
+		logger.Warnf("No tokens configured, every request is accepted")
+	}
+
+	store, err := kvserver.NewStore(*dataDir)
+	if err != nil {
+		fmt.Printf("Error opening data dir: %v\n", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		fmt.Printf("Error listening on %s: %v\n", *listenAddr, err)
+		os.Exit(1)
+	}
+
+	// Clients keep to the default keepalive enforcement policy, see
+	// kv.DefaultKeepaliveTime.
+	grpcServer := grpc.NewServer()
+	kvserver.NewServer(store, config, logger).Register(grpcServer)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if config.Eviction.Enabled() {
+		logger.Infof("Eviction enabled, %s stored", humanize.Bytes(uint64(store.Size())))
+		go store.RunEviction(ctx, config.Eviction, logger)
+	} else {
+		logger.Warnf("No eviction configured, the data dir grows without bounds")
+	}
+
+	go func() {
+		<-ctx.Done()
+		logger.Infof("Shutting down")
+		grpcServer.GracefulStop()
+	}()
+
+	logger.Infof("Serving %s on %s", *dataDir, listener.Addr())
+	if err := grpcServer.Serve(listener); err != nil {
+		fmt.Printf("Error serving: %v\n", err)
+		os.Exit(1)
+	}
+}